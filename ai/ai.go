@@ -1,11 +1,16 @@
 package ai
 
 import (
+	"bytes"
 	. "playful-patterns.com/bakoko/ints"
 	. "playful-patterns.com/bakoko/world"
 )
 
 type PlayerAI struct {
+	// The index in World.Players of the player that the AI plays. It is up
+	// to whoever creates the AI, it stays the same when the AI is
+	// initialized or deserialized.
+	PlayerIdx                 int
 	TargetPt                  Pt
 	HasTarget                 bool
 	DebugInfo                 DebugInfo
@@ -17,6 +22,10 @@ type PlayerAI struct {
 	initializedWalkableMatrix bool
 	pathfinding               Pathfinding
 	frameIdx                  Int
+	// The frame of the world we last reacted to, to tell if we missed
+	// frames.
+	lastWorldFrameIdx    int
+	hasLastWorldFrameIdx bool
 }
 
 func PlayerIsAt(p *Player, pt Pt) bool {
@@ -31,9 +40,47 @@ func (mind *PlayerAI) Initialize() {
 	mind.LastShot = mind.frameIdx
 }
 
-func (mind *PlayerAI) Step(w *World) (input PlayerInput) {
+// Identity tells which AI this is and which code it was built from, so that
+// a recording can tell if the AI that played it has changed since.
+func (mind *PlayerAI) Identity() string {
+	return "PlayerAI " + BuildHash()
+}
+
+// Serialize writes what the AI needs in order to continue playing from where
+// it is. The walkable matrix and the pathfinding are not written, they are
+// computed again from the world.
+func (mind *PlayerAI) Serialize() []byte {
+	buf := new(bytes.Buffer)
+	Serialize(buf, mind.TargetPt)
+	Serialize(buf, mind.HasTarget)
+	Serialize(buf, mind.PauseBetweenShots)
+	Serialize(buf, mind.LastShot)
+	Serialize(buf, mind.frameIdx)
+	return buf.Bytes()
+}
+
+func (mind *PlayerAI) Deserialize(buf *bytes.Buffer) {
+	Deserialize(buf, &mind.TargetPt)
+	Deserialize(buf, &mind.HasTarget)
+	Deserialize(buf, &mind.PauseBetweenShots)
+	Deserialize(buf, &mind.LastShot)
+	Deserialize(buf, &mind.frameIdx)
+	mind.initializedWalkableMatrix = false
+}
+
+// Step reacts to the world of the given frame.
+func (mind *PlayerAI) Step(w *World, frameIdx int) (input PlayerInput) {
 	defer mind.frameIdx.Inc()
 
+	// If the world went on without us (e.g. we were too slow for it), our
+	// own clock must skip the frames we missed as well, otherwise we would
+	// wait too long between shots.
+	if mind.hasLastWorldFrameIdx && frameIdx > mind.lastWorldFrameIdx+1 {
+		mind.frameIdx.Add(I(frameIdx - mind.lastWorldFrameIdx - 1))
+	}
+	mind.lastWorldFrameIdx = frameIdx
+	mind.hasLastWorldFrameIdx = true
+
 	// Check somehow if the world-main is initialized.
 	if w.Obstacles.NRows().Leq(ZERO) {
 		// If there's no world-main matrix, we can probably safely assume
@@ -41,13 +88,16 @@ func (mind *PlayerAI) Step(w *World) (input PlayerInput) {
 		return
 	}
 
-	// Check if us or the opponent is defeated.
-	if w.Player1.Health.Eq(ZERO) || w.Player2.Health.Eq(ZERO) {
+	if mind.PlayerIdx >= len(w.Players) {
 		return
 	}
+	body := &w.Players[mind.PlayerIdx]
 
-	// TODO: find a more generic way of selecting which body is which.
-	body := &w.Player2
+	// Check if we are defeated or if there's nobody left to fight.
+	if body.Defeated() || w.MatchOver() {
+		return
+	}
+	enemy := mind.closestEnemy(w)
 
 	if w.JustReloaded.Eq(ONE) {
 		// Re-initialize the mind to initial conditions if the world just
@@ -63,7 +113,7 @@ func (mind *PlayerAI) Step(w *World) (input PlayerInput) {
 
 	if mind.frameIdx.Minus(mind.LastShot).Gt(mind.PauseBetweenShots) {
 		ballStart := body.Bounds.Center
-		ballEnd := w.Player1.Bounds.Center
+		ballEnd := enemy.Bounds.Center
 		if pathIsClear(w, ballStart, ballEnd, U(50)) {
 			input.Shoot = true
 			input.ShootPt = ballEnd
@@ -73,7 +123,7 @@ func (mind *PlayerAI) Step(w *World) (input PlayerInput) {
 
 	//return
 
-	finalTarget := w.Player1.Bounds.Center
+	finalTarget := enemy.Bounds.Center
 	if mind.HasTarget {
 		// If we're at the target, disable the target which signals we need
 		// a new path.
@@ -155,6 +205,24 @@ func (mind *PlayerAI) Step(w *World) (input PlayerInput) {
 	return
 }
 
+// The enemy that is standing closest to us. There is one, as long as the
+// match is not over.
+func (mind *PlayerAI) closestEnemy(w *World) (enemy *Player) {
+	body := &w.Players[mind.PlayerIdx]
+	var minDist Int
+	for i := range w.Players {
+		p := &w.Players[i]
+		if w.Teammates(mind.PlayerIdx, i) || p.Defeated() {
+			continue
+		}
+		dist := body.Bounds.Center.SquaredDistTo(p.Bounds.Center)
+		if enemy == nil || dist.Lt(minDist) {
+			enemy, minDist = p, dist
+		}
+	}
+	return
+}
+
 func pathIsClear(w *World, start Pt, end Pt, ballSize Int) bool {
 	squares := w.GetRelevantSquares(ballSize, start, end)
 	// Check if we can travel to newPos without collision.
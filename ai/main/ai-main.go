@@ -5,6 +5,7 @@ import (
 	. "playful-patterns.com/bakoko/ai"
 	. "playful-patterns.com/bakoko/proxy"
 	. "playful-patterns.com/bakoko/world"
+	"strconv"
 	"time"
 )
 
@@ -14,38 +15,26 @@ func main() {
 	var worldProxy WorldProxyTcpIp
 	var guiProxy GuiProxyTcpIp
 
-	worldProxy.Endpoint = os.Args[1] // localhost:56901 or localhost:56902
+	worldProxy.Endpoint = os.Args[1] // localhost:56901
 	worldProxy.Timeout = 0 * time.Millisecond
 	guiProxy.Endpoint = os.Args[2]
+	// Optionally, which player to be (1 is the first player). By default,
+	// the world gives us the first free player slot.
+	if len(os.Args) > 3 {
+		slot, err := strconv.Atoi(os.Args[3])
+		Check(err)
+		worldProxy.Slot = int64(slot)
+	}
 
-	var ai PlayerAI
-	ai.Initialize()
-	for {
-		w := getWorld(&worldProxy)
-		input := ai.Step(w)
-
-		// This should not block. The only reason for SendInput to fail is because
-		// the connection failed somehow. In which case, we should revert to getting
-		// the world again and re-computing our reaction.
-		worldProxy.SendInput(&input)
-
-		// This may or may not block, who cares?
-		guiProxy.SendPaintData(&ai.DebugInfo)
+	// We only know which player we are once the world gave us a slot. We
+	// get the same slot back if we lose the connection.
+	for worldProxy.Connect() != nil {
 	}
-}
 
-func getWorld(worldProxy WorldProxy) *World {
-	// This should block as the AI doesn't make sense if it doesn't
-	// synchronize with the simulation.
+	var ai PlayerAI
+	ai.PlayerIdx = int(worldProxy.GetSlot()) - 1
+	ai.Initialize()
 	for {
-		if err := worldProxy.Connect(); err != nil {
-			continue // Retry from the beginning.
-		}
-		var err error
-		var w *World
-		if w, err = worldProxy.GetWorld(); err != nil {
-			continue // Retry from the beginning.
-		}
-		return w
+		ai.StepRemote(&worldProxy, &guiProxy)
 	}
 }
@@ -0,0 +1,56 @@
+package ai
+
+import (
+	"bytes"
+	. "playful-patterns.com/bakoko/world"
+	"slices"
+)
+
+// PlayerAIs play every player of a world except the first one, which is
+// played by the human (or by the recording) in FusedPlay mode. There is
+// one AI per player, made when a world first has that player.
+type PlayerAIs struct {
+	AIs []PlayerAI
+}
+
+// Step returns the inputs of the players after the first one.
+func (a *PlayerAIs) Step(w *World, frameIdx int) []PlayerInput {
+	a.grow(len(w.Players) - 1)
+	var inputs []PlayerInput
+	for i := 1; i < len(w.Players); i++ {
+		inputs = append(inputs, a.AIs[i-1].Step(w, frameIdx))
+	}
+	return inputs
+}
+
+// Make sure there are at least n AIs.
+func (a *PlayerAIs) grow(n int) {
+	for len(a.AIs) < n {
+		var ai PlayerAI
+		ai.PlayerIdx = len(a.AIs) + 1
+		ai.Initialize()
+		a.AIs = append(a.AIs, ai)
+	}
+}
+
+// Clone copies the AIs, so that they can be restored later.
+func (a *PlayerAIs) Clone() PlayerAIs {
+	return PlayerAIs{slices.Clone(a.AIs)}
+}
+
+// Serialize writes the AIs one after the other. The state of a single
+// PlayerAI is the state of PlayerAIs with one AI.
+func (a *PlayerAIs) Serialize() []byte {
+	buf := new(bytes.Buffer)
+	for i := range a.AIs {
+		buf.Write(a.AIs[i].Serialize())
+	}
+	return buf.Bytes()
+}
+
+func (a *PlayerAIs) Deserialize(buf *bytes.Buffer) {
+	for i := 0; buf.Len() > 0; i++ {
+		a.grow(i + 1)
+		a.AIs[i].Deserialize(buf)
+	}
+}
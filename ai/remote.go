@@ -0,0 +1,37 @@
+package ai
+
+import (
+	. "playful-patterns.com/bakoko/proxy"
+	. "playful-patterns.com/bakoko/world"
+)
+
+// StepRemote plays one frame against a world that the AI only reaches
+// through proxies (SplitRecording mode): get the world, react to it, send the
+// reaction and show what the AI was thinking.
+func (mind *PlayerAI) StepRemote(worldProxy WorldProxy, guiProxy GuiProxy) {
+	w, frameIdx := getWorld(worldProxy)
+	input := mind.Step(w, frameIdx)
+
+	// This should not block. The only reason for SendInput to fail is because
+	// the connection failed somehow. In which case, we should revert to getting
+	// the world again and re-computing our reaction.
+	worldProxy.SendInput(&input, frameIdx)
+
+	// This may or may not block, who cares?
+	guiProxy.SendPaintData(&mind.DebugInfo)
+}
+
+func getWorld(worldProxy WorldProxy) (*World, int) {
+	// This should block as the AI doesn't make sense if it doesn't
+	// synchronize with the simulation.
+	for {
+		if err := worldProxy.Connect(); err != nil {
+			continue // Retry from the beginning.
+		}
+		w, frameIdx, err := worldProxy.GetWorld()
+		if err != nil {
+			continue // Retry from the beginning.
+		}
+		return w, frameIdx
+	}
+}
@@ -0,0 +1,69 @@
+package ai
+
+import (
+	"github.com/stretchr/testify/assert"
+	"playful-patterns.com/bakoko/internal/worldtest"
+	. "playful-patterns.com/bakoko/proxy"
+	. "playful-patterns.com/bakoko/world"
+	"testing"
+	"time"
+)
+
+func testWorldConfig() WorldConfig {
+	return WorldConfig{WorldJson: worldtest.WorldJson, Level: worldtest.Level}
+}
+
+// Run the world and two AIs like in SplitRecording mode, with the channel
+// proxies instead of TCP/IP. The game played like this must be the same as
+// the game played with the AIs stepped directly by the world.
+func TestPlayerAI_StepRemote(t *testing.T) {
+	const nFrames = 300
+
+	var player1Channel, player2Channel PlayerChannel
+	player1Channel.Initialize()
+	player2Channel.Initialize()
+	var paintChannel PaintChannel
+	paintChannel.Initialize()
+
+	for idx, c := range []*PlayerChannel{&player1Channel, &player2Channel} {
+		go func(idx int, c *PlayerChannel) {
+			worldProxy := WorldProxyChan{c, time.Second, int64(idx) + 1}
+			guiProxy := GuiProxyChan{&paintChannel}
+			var ai PlayerAI
+			ai.PlayerIdx = idx
+			ai.Initialize()
+			for i := 0; i < nFrames; i++ {
+				ai.StepRemote(&worldProxy, &guiProxy)
+			}
+		}(idx, c)
+	}
+
+	var w World
+	LoadWorldFromConfig(&w, testWorldConfig())
+	player1 := PlayerProxyChan{&player1Channel}
+	player2 := PlayerProxyChan{&player2Channel}
+	for i := 0; i < nFrames; i++ {
+		input := Input{Players: make([]PlayerInput, 2)}
+		input.Players[0] = *player1.SendWorldGetInput(&w, i)
+		input.Players[1] = *player2.SendWorldGetInput(&w, i)
+		w.Step(&input, i)
+	}
+
+	// The AIs painted something.
+	painter := PainterProxyChan{&paintChannel}
+	painter.GetPaintData()
+
+	var expected World
+	LoadWorldFromConfig(&expected, testWorldConfig())
+	var ai1, ai2 PlayerAI
+	ai2.PlayerIdx = 1
+	ai1.Initialize()
+	ai2.Initialize()
+	for i := 0; i < nFrames; i++ {
+		input := Input{Players: make([]PlayerInput, 2)}
+		input.Players[0] = ai1.Step(&expected, i)
+		input.Players[1] = ai2.Step(&expected, i)
+		expected.Step(&input, i)
+	}
+	assert.Equal(t, expected.Checksum(), w.Checksum())
+}
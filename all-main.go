@@ -1,45 +1,183 @@
 package main
 
 import (
+	"flag"
 	"github.com/hajimehoshi/ebiten/v2"
-	"os"
+	"log"
 	. "playful-patterns.com/bakoko/ai"
 	. "playful-patterns.com/bakoko/gui"
+	. "playful-patterns.com/bakoko/proxy"
 	. "playful-patterns.com/bakoko/world"
 	. "playful-patterns.com/bakoko/world/world-run"
+	"time"
 )
 
 func main() {
-	if len(os.Args) == 1 {
+	// By default, the players after the first one play back their recorded
+	// inputs (if the recording has them). With -simulate-ai, the current AI
+	// plays them instead.
+	simulateAi := flag.Bool("simulate-ai", false,
+		"during playback, let the current AI play the players after the "+
+			"first one")
+	// With -split, the world, the AI and the gui talk to each other like in
+	// SplitRecording mode, except they all run in this process.
+	split := flag.Bool("split", false,
+		"run the world, the AI and the gui separately, in one process")
+	// With -host or -join, two people play against each other from two
+	// machines, in lockstep or rollback mode. One of them hosts the game and
+	// the other joins it.
+	host := flag.String("host", "",
+		"host a game against another player, at this endpoint")
+	join := flag.String("join", "",
+		"join the game of another player, at this endpoint")
+	inputDelay := flag.Int("input-delay", 3,
+		"when hosting, the number of frames an input takes to be used")
+	rollback := flag.Int("rollback", 0,
+		"when hosting, play in rollback mode instead of lockstep mode, "+
+			"with the world running at most this many frames ahead")
+	flag.Parse()
+
+	if flag.NArg() == 0 && *host != "" {
+		RunGuiLockstepPlay(GetNewRecordingFile(), *host, true, *inputDelay,
+			*rollback)
+	} else if flag.NArg() == 0 && *join != "" {
+		RunGuiLockstepPlay(GetNewRecordingFile(), *join, false, *inputDelay,
+			*rollback)
+	} else if flag.NArg() == 0 && *split {
+		RunGuiSplitPlay(GetNewRecordingFile())
+	} else if flag.NArg() == 0 {
 		RunGuiFusedPlay(GetNewRecordingFile())
 	} else {
-		RunGuiFusedPlayback(os.Args[1])
-		//RunGuiFusedPlayback("d:/gms/bakoko/recordings/recorded-inputs-2024-03-20-000000")
+		RunGuiFusedPlayback(flag.Arg(0), *simulateAi)
+		//RunGuiFusedPlayback("d:/gms/bakoko/recordings/recorded-inputs-2024-03-20-000000", false)
 	}
 }
 
 func RunGuiFusedPlay(recordingFile string) {
 	var worldRunner WorldRunner
-	var player2Ai PlayerAI
-	worldRunner.Initialize(recordingFile, true)
+	var ais PlayerAIs
+	worldRunner.Initialize(recordingFile, (&PlayerAI{}).Identity(), true)
 
 	var g Gui
-	g.Init(nil, &worldRunner, &player2Ai, "", []string{})
+	g.Init(nil, &worldRunner, &ais, "", false, []string{})
 
 	// Start the game.
 	err := ebiten.RunGame(&g)
+	worldRunner.Close()
 	Check(err)
 }
 
-func RunGuiFusedPlayback(recordingFile string) {
+func RunGuiFusedPlayback(recordingFile string, simulateAi bool) {
+	// The Gui initializes the world runner for playing back the recording.
 	var worldRunner WorldRunner
-	var player2Ai PlayerAI
-	worldRunner.Initialize("", false)
+	var ais PlayerAIs
+
+	var g Gui
+	g.Init(nil, &worldRunner, &ais, recordingFile, simulateAi, []string{})
+
+	// Start the game.
+	err := ebiten.RunGame(&g)
+	Check(err)
+}
+
+// This is what world/main, ai/main and gui/main do together, with channels
+// instead of TCP/IP.
+func RunGuiSplitPlay(recordingFile string) {
+	var player1Channel, player2Channel PlayerChannel
+	player1Channel.Initialize()
+	player2Channel.Initialize()
+	var worldPaintChannel, aiPaintChannel PaintChannel
+	worldPaintChannel.Initialize()
+	aiPaintChannel.Initialize()
+
+	// The world.
+	go func() {
+		player1 := PlayerProxyChan{&player1Channel}
+		player2 := PlayerProxyChan{&player2Channel}
+		guiProxy := GuiProxyChan{&worldPaintChannel}
+
+		var worldRunner WorldRunner
+		worldRunner.Initialize(recordingFile, "in-process", false)
+		for {
+			// First, send the current world to players and get their reactions.
+			inputs := SendWorldGetInputs(worldRunner.GetWorld(),
+				worldRunner.GetFrameIdx(), &player1, &player2) // Blocks.
+			input := Input{Players: inputs}
+
+			// Second, use their reactions to update the world.
+			worldRunner.Step(input)
+
+			// Third, send any debug info generated by the step.
+			guiProxy.SendPaintData(worldRunner.GetDebugInfo())
+		}
+	}()
+
+	// The AI.
+	go func() {
+		worldProxy := WorldProxyChan{&player2Channel, 0, 2}
+		guiProxy := GuiProxyChan{&aiPaintChannel}
+
+		var ai PlayerAI
+		ai.PlayerIdx = 1
+		ai.Initialize()
+		for {
+			ai.StepRemote(&worldProxy, &guiProxy)
+		}
+	}()
 
+	// The gui.
+	worldProxy := WorldProxyChan{&player1Channel, 1000 * time.Millisecond, 1}
 	var g Gui
-	g.Init(nil, &worldRunner, &player2Ai, recordingFile, []string{})
+	g.Init(&worldProxy, nil, nil, "", false, []string{})
+	g.AddPainterProxy(&PainterProxyChan{&worldPaintChannel})
+	g.AddPainterProxy(&PainterProxyChan{&aiPaintChannel})
+
+	// Start the game.
+	err := ebiten.RunGame(&g)
+	Check(err)
+}
+
+// Play against another player who runs this on another machine. There is
+// no world-main, each of us runs the world.
+func RunGuiLockstepPlay(recordingFile string, endpoint string, host bool,
+	inputDelay int, rollback int) {
+	var peer LockstepPeer
+	peer.Endpoint = endpoint
+	peer.Host = host
+	peer.Timeout = 100 * time.Millisecond
+
+	// The host decides the seed and the level, the other player takes them.
+	var setup LockstepSetup
+	setup.Seed = time.Now().UnixNano()
+	setup.Config = LoadWorldConfig()
+	setup.InputDelay = int64(inputDelay)
+	setup.Rollback = int64(rollback)
+	log.Printf("waiting for the other player at %s", endpoint)
+	for {
+		var err error
+		if setup, err = peer.Connect(setup); err == nil {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+
+	var worldRunner WorldRunner
+	worldRunner.InitializeLockstep(recordingFile, setup.Seed, setup.Config)
+
+	var g Gui
+	if setup.Rollback > 0 {
+		log.Printf("playing in rollback mode, at most %d frames ahead",
+			setup.Rollback)
+		g.InitRollback(&peer, &worldRunner, int(setup.Rollback))
+	} else {
+		log.Printf("playing with an input delay of %d frames",
+			setup.InputDelay)
+		g.InitLockstep(&peer, &worldRunner)
+	}
 
 	// Start the game.
 	err := ebiten.RunGame(&g)
+	worldRunner.Close()
+	peer.Close()
 	Check(err)
 }
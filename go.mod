@@ -5,6 +5,7 @@ go 1.21.1
 require (
 	github.com/fzipp/astar v0.2.0
 	github.com/hajimehoshi/ebiten/v2 v2.6.3
+	github.com/stretchr/testify v1.8.4
 	golang.org/x/image v0.14.0
 )
 
@@ -13,7 +14,6 @@ require (
 	github.com/ebitengine/purego v0.5.0 // indirect
 	github.com/jezek/xgb v1.1.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.8.4 // indirect
 	golang.org/x/exp/shiny v0.0.0-20230817173708-d852ddb80c63 // indirect
 	golang.org/x/mobile v0.0.0-20230922142353-e2f452493d57 // indirect
 	golang.org/x/sync v0.3.0 // indirect
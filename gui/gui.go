@@ -1,6 +1,7 @@
 package gui
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/hajimehoshi/ebiten/v2/ebitenutil"
@@ -11,6 +12,7 @@ import (
 	"golang.org/x/image/font/opentype"
 	"image"
 	"image/color"
+	"log"
 	"math"
 	"os"
 	. "playful-patterns.com/bakoko/ai"
@@ -34,6 +36,19 @@ type GuiData struct {
 	PlaybackBarHeight int
 }
 
+// During playback, a snapshot of the world and the AI is taken every
+// playbackSnapshotInterval frames. Seeking starts from the closest snapshot
+// instead of replaying everything from the first frame.
+const playbackSnapshotInterval = 120
+
+type playbackSnapshot struct {
+	runner RunnerSnapshot
+	// A copy of the AIs is enough. Their slices are either never changed
+	// after the AIs initialize them or are scratch buffers reset before every
+	// use.
+	ais PlayerAIs
+}
+
 type Gui struct {
 	w              *World
 	worldProxy     WorldProxy
@@ -65,24 +80,44 @@ type Gui struct {
 	folderWatcher  FolderWatcher
 	hitAnimation1  int
 	hitAnimation2  int
-	// The UI is responsible for keeping track of state changes that are
-	// relevant for it.
-	player1PreviousHealth Int
-	player2PreviousHealth Int
-	state                 GameState
-	defaultFont           font.Face
-	gameOverAnimation     int
-	playerInputs          []PlayerInput
-	frameIdx              int
-	leftButtonClicked     bool
-	leftButtonPressed     bool
-	mousePosX             int
-	mousePosY             int
-	targetFrame           int
-	worldRunner           *WorldRunner
-	player2Ai             *PlayerAI
-	fusedMode             bool
-	playbackPaused        bool
+	// The events of the last world we reacted to. The same world can be
+	// shown more than once, but its events must only be shown once.
+	shownEvents       []Event
+	state             GameState
+	defaultFont       font.Face
+	gameOverAnimation int
+	recording         *Recording
+	frameIdx          int
+	leftButtonClicked bool
+	leftButtonPressed bool
+	mousePosX         int
+	mousePosY         int
+	targetFrame       int
+	worldRunner       *WorldRunner
+	ais               *PlayerAIs // The other players, in fused mode.
+	player2Source     Player2Source
+	snapshots         map[int]playbackSnapshot
+	// In fused mode the gui runs the world itself, instead of getting it
+	// through the world proxy. Playback, saving and loading states and the
+	// lockstep modes need the world runner itself, not just the worlds, so
+	// they only work in fused mode.
+	fusedMode      bool
+	playbackPaused bool
+	// The frame of the last world we got from the world proxy. Our input
+	// is the reaction to it.
+	worldFrameIdx int
+	// The index in World.Players of the player we play. In split mode, the
+	// world decides which slot we get, in lockstep mode the peers decide who
+	// hosts. Otherwise we are the first player.
+	playerIdx int
+	// The other player, if we play in lockstep mode, and why the game
+	// stopped, if it did.
+	lockstep    *LockstepPeer
+	lockstepErr error
+	// In rollback mode, the world we show runs ahead of the world runner.
+	rollback *RollbackRunner
+	// The last frame of the world runner we sent the checksum of.
+	checksumFrameIdx int
 }
 
 func colorHex(hexVal int) color.Color {
@@ -100,8 +135,46 @@ func colorHex(hexVal int) color.Color {
 	}
 }
 
-func playerWasJustHit(player Player, prevHealth Int) bool {
-	return player.Health.Lt(prevHealth)
+// Show when we were hit (hitAnimation1) and when an enemy was hit
+// (hitAnimation2).
+func (g *Gui) updateHitAnimations(world *World) {
+	if slices.Equal(world.Events, g.shownEvents) {
+		return
+	}
+	g.shownEvents = slices.Clone(world.Events)
+	for _, e := range EventsOf(world.Events, EventPlayerHit) {
+		i := int(e.Player)
+		if !g.inWorld(world) || i >= len(world.Players) {
+			continue
+		}
+		if i == g.playerIdx {
+			g.hitAnimation1 = 255
+		} else if !world.Teammates(g.playerIdx, i) {
+			g.hitAnimation2 = 255
+		}
+	}
+}
+
+// Tells if the player we play is part of the world. It may not be yet, if
+// the world has fewer players than the slot we got.
+func (g *Gui) inWorld(world *World) bool {
+	return g.playerIdx < len(world.Players)
+}
+
+// We lost when we are defeated and won when all our enemies are. If both
+// happened, our team won without us.
+func (g *Gui) updateGameOver(world *World) {
+	if !g.inWorld(world) {
+		return
+	}
+	if world.Players[g.playerIdx].Defeated() {
+		g.state = GameLost
+		g.gameOverAnimation = -500
+	}
+	if world.EnemiesDefeated(g.playerIdx) {
+		g.state = GameWon
+		g.gameOverAnimation = -500
+	}
 }
 
 func (g *Gui) UpdateGameOngoing(world *World) PlayerInput {
@@ -136,27 +209,8 @@ func (g *Gui) UpdateGameOngoing(world *World) PlayerInput {
 
 	if world != nil {
 		// React to updates.
-		// Player1 was just hit.
-		if playerWasJustHit(world.Player1, g.player1PreviousHealth) {
-			g.hitAnimation1 = 255
-		}
-		g.player1PreviousHealth = world.Player1.Health
-
-		// Player2 was just hit.
-		if playerWasJustHit(world.Player2, g.player2PreviousHealth) {
-			g.hitAnimation2 = 255
-		}
-		g.player2PreviousHealth = world.Player2.Health
-
-		if world.Player1.Health.Eq(ZERO) {
-			g.state = GameLost
-			g.gameOverAnimation = -500
-		}
-
-		if world.Player2.Health.Eq(ZERO) {
-			g.state = GameWon
-			g.gameOverAnimation = -500
-		}
+		g.updateHitAnimations(world)
+		g.updateGameOver(world)
 	}
 
 	return playerInput
@@ -178,19 +232,9 @@ func (g *Gui) UpdateGamePaused(world *World) PlayerInput {
 	}
 
 	if world != nil {
-		if world.Player1.Health.Eq(ZERO) {
-			// This can only happen if the GUI was restarted and it started in
-			// paused mode, but the world was already in lost mode.
-			g.state = GameLost
-			g.gameOverAnimation = -500
-		}
-
-		if world.Player2.Health.Eq(ZERO) {
-			// This can only happen if the GUI was restarted and it started in
-			// paused mode, but the world was already in won mode.
-			g.state = GameWon
-			g.gameOverAnimation = -500
-		}
+		// This can only happen if the GUI was restarted and it started in
+		// paused mode, but the world was already in lost or won mode.
+		g.updateGameOver(world)
 	}
 
 	unpause := inpututil.IsMouseButtonJustPressed(ebiten.MouseButton0)
@@ -225,7 +269,8 @@ func (g *Gui) UpdateGameWon(world *World) PlayerInput {
 		g.state = GameOngoing
 	}
 
-	if world != nil && world.Player2.Health.Neq(ZERO) {
+	if world != nil && g.inWorld(world) &&
+		!world.EnemiesDefeated(g.playerIdx) {
 		// This should normally happen only if the world is restarted/reloaded.
 		g.state = GameOngoing
 	}
@@ -233,6 +278,14 @@ func (g *Gui) UpdateGameWon(world *World) PlayerInput {
 	return playerInput
 }
 
+// A spectator only watches, there is no input to give the world.
+func (g *Gui) UpdateSpectating(world *World) {
+	if world != nil {
+		// React to updates.
+		g.updateHitAnimations(world)
+	}
+}
+
 func (g *Gui) UpdatePlayback(world *World) PlayerInput {
 	// Get keyboard input.
 	var pressedKeys []ebiten.Key
@@ -246,8 +299,8 @@ func (g *Gui) UpdatePlayback(world *World) PlayerInput {
 
 	if slices.Contains(pressedKeys, ebiten.KeyRight) && slices.Contains(pressedKeys, ebiten.KeyShift) {
 		g.targetFrame = g.frameIdx + 1
-		if g.targetFrame >= len(g.playerInputs) {
-			g.targetFrame = len(g.playerInputs) - 1
+		if g.targetFrame >= len(g.recording.Inputs) {
+			g.targetFrame = len(g.recording.Inputs) - 1
 		}
 	}
 
@@ -265,8 +318,8 @@ func (g *Gui) UpdatePlayback(world *World) PlayerInput {
 	//if slices.Contains(justPressedKeys, ebiten.KeyRight) && !slices.Contains(pressedKeys, ebiten.KeyShift) {
 	if slices.Contains(pressedKeys, ebiten.KeyRight) && !slices.Contains(pressedKeys, ebiten.KeyShift) {
 		g.targetFrame = g.frameIdx + 10
-		if g.targetFrame >= len(g.playerInputs) {
-			g.targetFrame = len(g.playerInputs) - 1
+		if g.targetFrame >= len(g.recording.Inputs) {
+			g.targetFrame = len(g.recording.Inputs) - 1
 		}
 	}
 
@@ -285,29 +338,25 @@ func (g *Gui) UpdatePlayback(world *World) PlayerInput {
 	g.mousePosX, g.mousePosY = ebiten.CursorPosition()
 
 	if g.targetFrame >= 0 {
-		// Rewind.
-		// Reload world.
-		var initialPlayerInput PlayerInput
-		initialPlayerInput.Reload = true
-		initialPlayerInput.Pause = true
-		g.SendInput(initialPlayerInput)
-
-		// Replay the world.
-		for i := 0; i < g.targetFrame; i++ {
+		// Rewind to the closest snapshot.
+		g.restorePlaybackSnapshot(g.targetFrame)
+
+		// Replay the world from there.
+		for i := g.worldRunner.GetFrameIdx(); i < g.targetFrame; i++ {
 			g.w = g.GetWorld()
-			g.SendInput(g.playerInputs[i])
+			g.SendInput(g.recording.Inputs[i].Player(0))
 		}
 		g.w = g.GetWorld()
 		g.frameIdx = g.targetFrame
 
-		g.player1PreviousHealth = g.w.Player1.Health
-		g.player2PreviousHealth = g.w.Player2.Health
+		// Don't show hit animations for the frames we jumped over.
+		g.shownEvents = slices.Clone(g.w.Events)
 		g.targetFrame = -1
 	}
 
 	var playerInput PlayerInput
-	if g.frameIdx < len(g.playerInputs) {
-		playerInput = g.playerInputs[g.frameIdx]
+	if g.frameIdx < len(g.recording.Inputs) {
+		playerInput = g.recording.Inputs[g.frameIdx].Player(0)
 	}
 	if !g.playbackPaused {
 		g.frameIdx++
@@ -315,20 +364,43 @@ func (g *Gui) UpdatePlayback(world *World) PlayerInput {
 
 	if world != nil {
 		// React to updates.
-		// Player1 was just hit.
-		if playerWasJustHit(world.Player1, g.player1PreviousHealth) {
-			g.hitAnimation1 = 255
-		}
-		g.player1PreviousHealth = world.Player1.Health
+		g.updateHitAnimations(world)
+	}
 
-		// Player2 was just hit.
-		if playerWasJustHit(world.Player2, g.player2PreviousHealth) {
-			g.hitAnimation2 = 255
+	return playerInput
+}
+
+func (g *Gui) takePlaybackSnapshot() {
+	frameIdx := g.worldRunner.GetFrameIdx()
+	if frameIdx%playbackSnapshotInterval != 0 {
+		return
+	}
+	if _, ok := g.snapshots[frameIdx]; ok {
+		return
+	}
+	g.snapshots[frameIdx] = playbackSnapshot{g.worldRunner.TakeSnapshot(),
+		g.ais.Clone()}
+}
+
+// Go back to the latest snapshot that is not after targetFrame, or to the
+// start of the recording if there is no such snapshot.
+func (g *Gui) restorePlaybackSnapshot(targetFrame int) {
+	bestFrameIdx := -1
+	for frameIdx := range g.snapshots {
+		if frameIdx <= targetFrame && frameIdx > bestFrameIdx {
+			bestFrameIdx = frameIdx
 		}
-		g.player2PreviousHealth = world.Player2.Health
 	}
 
-	return playerInput
+	if bestFrameIdx < 0 {
+		g.worldRunner.InitializePlayback(g.recording)
+		*g.ais = PlayerAIs{}
+		return
+	}
+
+	snapshot := g.snapshots[bestFrameIdx]
+	g.worldRunner.RestoreSnapshot(snapshot.runner)
+	*g.ais = snapshot.ais.Clone()
 }
 
 func (g *Gui) UpdateGameLost(world *World) PlayerInput {
@@ -346,7 +418,8 @@ func (g *Gui) UpdateGameLost(world *World) PlayerInput {
 		g.state = GameOngoing
 	}
 
-	if world != nil && world.Player1.Health.Neq(ZERO) {
+	if world != nil && g.inWorld(world) &&
+		!world.Players[g.playerIdx].Defeated() {
 		// This should normally happen only if the world is restarted/reloaded.
 		g.state = GameOngoing
 	}
@@ -356,7 +429,9 @@ func (g *Gui) UpdateGameLost(world *World) PlayerInput {
 
 func (g *Gui) GetWorld() *World {
 	// Get the world.
-	if g.fusedMode {
+	if g.rollback != nil {
+		return g.rollback.GetWorld()
+	} else if g.fusedMode {
 		return g.worldRunner.GetWorld()
 	} else {
 		// Here I want to block but only if there's a connection.
@@ -368,30 +443,71 @@ func (g *Gui) GetWorld() *World {
 			return nil // Nevermind, try again next frame.
 		}
 
-		w, err := g.worldProxy.GetWorld()
+		w, frameIdx, err := g.worldProxy.GetWorld()
 		if err != nil {
 			return nil // Nevermind, try again next frame.
 		}
+		g.worldFrameIdx = frameIdx
+		if slot := g.worldProxy.GetSlot(); slot > 0 {
+			g.playerIdx = int(slot) - 1
+		}
 		return w
 	}
 }
 
 func (g *Gui) SendInput(playerInput PlayerInput) {
 	// Update the world if there is one.
-	if g.fusedMode {
+	if g.rollback != nil {
+		g.sendInputRollback(playerInput)
+	} else if g.lockstep != nil {
+		// Step the world once we have the input of the other player as
+		// well. Until then, the world stays where it is.
+		wr := g.worldRunner
+		input, ok, err := g.lockstep.Step(playerInput, wr.GetFrameIdx(),
+			wr.GetWorld().Checksum())
+		if err != nil {
+			g.stopLockstep(err)
+			return
+		}
+		if ok {
+			wr.Step(input)
+		}
+	} else if g.fusedMode {
 		var input Input
-		input.Player1Input = playerInput
+		input.Players = []PlayerInput{playerInput}
+
+		if g.state == Playback && g.player2Source == Player2Recorded {
+			// Use what the other players did when the recording was made.
+			frameIdx := g.worldRunner.GetFrameIdx()
+			if frameIdx < len(g.recording.Inputs) {
+				recorded := g.recording.Inputs[frameIdx].Players
+				if len(recorded) > 1 {
+					input.Players = append(input.Players, recorded[1:]...)
+				}
+			}
+		} else {
+			// If a saved state was just loaded, the AIs continue from the
+			// state they were in when the game was saved.
+			if aiState := g.worldRunner.GetLoadedAIState(); aiState != nil {
+				g.ais.Deserialize(bytes.NewBuffer(aiState))
+			}
 
-		// Step the AI player.
-		input.Player2Input = g.player2Ai.Step(g.w)
+			// Step the AI players.
+			input.Players = append(input.Players, g.ais.Step(g.w,
+				g.worldRunner.GetFrameIdx())...)
+		}
 
 		// Now, step the world.
 		g.worldRunner.Step(input)
+
+		if g.state == Playback {
+			g.takePlaybackSnapshot()
+		}
 	} else {
 		// Here I want to attempt to send only if there is a connection.
 		// If there isn't, a new connection should not be attempted. That
 		// should happen before GetWorld.
-		if err := g.worldProxy.SendInput(&playerInput); err != nil {
+		if err := g.worldProxy.SendInput(&playerInput, g.worldFrameIdx); err != nil {
 			// Have some appropriate reaction to not being able to send our
 			// reaction to the current world state.
 			return // Nevermind, try again next frame.
@@ -399,7 +515,77 @@ func (g *Gui) SendInput(playerInput PlayerInput) {
 	}
 }
 
+func (g *Gui) sendInputRollback(playerInput PlayerInput) {
+	// Fix the frames we guessed wrong, now that we know better.
+	remoteInputs, err := g.lockstep.ReceiveInputs()
+	if err != nil {
+		g.stopLockstep(err)
+		return
+	}
+	for _, in := range remoteInputs {
+		g.rollback.SetRemoteInput(in.FrameIdx, in.Input)
+	}
+
+	// Don't get too far ahead of the other player.
+	if !g.rollback.CanStep() {
+		return
+	}
+
+	// Along with our input goes the checksum of the last world without
+	// guesses in it, if we didn't send it already.
+	wr := g.worldRunner
+	checksumFrameIdx := -1
+	if wr.GetFrameIdx() > g.checksumFrameIdx {
+		checksumFrameIdx = wr.GetFrameIdx()
+		g.checksumFrameIdx = checksumFrameIdx
+	}
+	err = g.lockstep.SendInput(playerInput, g.rollback.GetFrameIdx(),
+		checksumFrameIdx, wr.GetWorld().Checksum())
+	if err != nil {
+		g.stopLockstep(err)
+		return
+	}
+	g.rollback.Step(playerInput)
+}
+
+func (g *Gui) stopLockstep(err error) {
+	log.Println(err)
+	g.lockstepErr = err
+	g.state = LockstepFailed
+}
+
+// The file where the game is saved to and loaded from with F5 and F9.
+const savedStateFile = "saved-state.bks"
+
+// Save the game with F5 and load it with F9, so that a situation can be set
+// up once and then played again and again.
+// This only works in fused mode, where the Gui has access to the world.
+func (g *Gui) UpdateSaveLoad() {
+	var justPressedKeys []ebiten.Key
+	justPressedKeys = inpututil.AppendJustPressedKeys(justPressedKeys)
+
+	if slices.Contains(justPressedKeys, ebiten.KeyF5) {
+		g.worldRunner.SaveState(savedStateFile, g.ais.Serialize())
+		log.Printf("saved state to %s", savedStateFile)
+	}
+
+	if slices.Contains(justPressedKeys, ebiten.KeyF9) {
+		if !FileExists(savedStateFile) {
+			log.Printf("no saved state in %s", savedStateFile)
+			return
+		}
+		g.worldRunner.LoadState(savedStateFile)
+		log.Printf("loaded state from %s", savedStateFile)
+	}
+}
+
 func (g *Gui) Update() error {
+	// Only the inputs may change the world in lockstep mode, or the world
+	// of the other player would not be the same anymore.
+	if g.fusedMode && g.state != Playback && g.lockstep == nil {
+		g.UpdateSaveLoad()
+	}
+
 	g.w = g.GetWorld()
 
 	var playerInput PlayerInput
@@ -413,9 +599,12 @@ func (g *Gui) Update() error {
 		playerInput = g.UpdateGameLost(g.w)
 	} else if g.state == Playback {
 		playerInput = g.UpdatePlayback(g.w)
+	} else if g.state == Spectating {
+		g.UpdateSpectating(g.w)
 	}
 
-	if !g.playbackPaused {
+	if !g.playbackPaused && g.state != Spectating &&
+		g.state != LockstepFailed {
 		g.SendInput(playerInput)
 	}
 
@@ -628,25 +817,25 @@ func (g *Gui) Draw(screen *ebiten.Image) {
 		}
 	}
 
-	// Player1
-	if g.w.Player1.State.Eq(PlayerStunned) {
-		g.DrawPlayer(g.player1Hit, g.ball1, g.health, &g.w.Player1)
-	} else {
-		g.DrawPlayer(g.player1, g.ball1, g.health, &g.w.Player1)
-	}
-
-	// Player2
-	if g.w.Player2.State.Eq(PlayerStunned) {
-		g.DrawPlayer(g.player2Hit, g.ball2, g.health, &g.w.Player2)
-	} else {
-		g.DrawPlayer(g.player2, g.ball2, g.health, &g.w.Player2)
+	// Players. We and our teammates look like player 1, our enemies look
+	// like player 2.
+	for i := range g.w.Players {
+		player := &g.w.Players[i]
+		playerImage, hitImage, ballImage := g.player1, g.player1Hit, g.ball1
+		if !g.inWorld(g.w) || !g.w.Teammates(g.playerIdx, i) {
+			playerImage, hitImage, ballImage = g.player2, g.player2Hit, g.ball2
+		}
+		if player.State.Eq(PlayerStunned) {
+			playerImage = hitImage
+		}
+		g.DrawPlayer(playerImage, ballImage, g.health, player)
 	}
 
 	// Balls
 	for _, ball := range g.w.Balls {
-		ballImage := g.ball1
-		if ball.Type.Eq(I(2)) {
-			ballImage = g.ball2
+		ballImage := g.ball2
+		if g.inWorld(g.w) && g.w.FriendlyBall(g.w.Players[g.playerIdx], ball) {
+			ballImage = g.ball1
 		}
 		g.DrawSprite(ballImage,
 			g.WorldToScreen(ball.Bounds.Center.X),
@@ -670,7 +859,11 @@ func (g *Gui) Draw(screen *ebiten.Image) {
 	} else if g.state == GameLost {
 		message = "You lost. Press R to play again."
 	} else if g.state == Playback {
-		message = fmt.Sprintf("Playing back frame %d / %d", g.frameIdx, len(g.playerInputs))
+		message = fmt.Sprintf("Playing back frame %d / %d", g.frameIdx, len(g.recording.Inputs))
+	} else if g.state == Spectating {
+		message = "Spectating."
+	} else if g.state == LockstepFailed {
+		message = fmt.Sprintf("The game stopped: %v", g.lockstepErr)
 	} else {
 		Check(fmt.Errorf("unhandled game state: %d", g.state))
 	}
@@ -829,11 +1022,11 @@ func (g *Gui) DrawPlaybackBar(screen *ebiten.Image) {
 			30)
 
 		factor := (mx - x) / width
-		g.targetFrame = int(factor * float64(len(g.playerInputs)))
+		g.targetFrame = int(factor * float64(len(g.recording.Inputs)))
 	}
 
 	// cursor
-	factor := float64(g.frameIdx) / float64(len(g.playerInputs))
+	factor := float64(g.frameIdx) / float64(len(g.recording.Inputs))
 	cursorX := x + factor*width
 	g.DrawSprite(g.cursor, cursorX, y+45/2, 45)
 }
@@ -850,6 +1043,8 @@ const (
 	GameWon
 	GameLost
 	Playback
+	Spectating
+	LockstepFailed
 )
 
 func loadImage(str string) *ebiten.Image {
@@ -960,15 +1155,47 @@ func (g *Gui) UpdateDebugInfo(i int) {
 func (g *Gui) AddPainter(endpoint string) {
 	var p PainterProxyTcpIp
 	p.Endpoint = endpoint
-	g.painters = append(g.painters, &p)
+	g.AddPainterProxy(&p)
+}
+
+func (g *Gui) AddPainterProxy(p PainterProxy) {
+	g.painters = append(g.painters, p)
 	g.debugInfo = append(g.debugInfo, DebugInfo{})
 	g.debugInfoMutex = append(g.debugInfoMutex, sync.Mutex{})
 	i := len(g.painters) - 1
 	go g.UpdateDebugInfo(i)
 }
 
+// InitSpectator sets up the gui to watch a world that others play in. The
+// world proxy must connect to the world as a spectator.
+func (g *Gui) InitSpectator(worldProxy WorldProxy, painters []string) {
+	g.Init(worldProxy, nil, nil, "", false, painters)
+	g.state = Spectating
+}
+
+// InitLockstep sets up the gui to play against another player in lockstep
+// mode. The peer must be connected and the world runner initialized with
+// the setup the peer returned.
+func (g *Gui) InitLockstep(peer *LockstepPeer, worldRunner *WorldRunner) {
+	g.Init(nil, worldRunner, nil, "", false, []string{})
+	g.lockstep = peer
+	g.rollback = nil
+	g.playerIdx = peer.PlayerIdx()
+}
+
+// InitRollback is InitLockstep for rollback mode, where our world may run
+// up to maxFrames ahead of the inputs of the other player.
+func (g *Gui) InitRollback(peer *LockstepPeer, worldRunner *WorldRunner,
+	maxFrames int) {
+	g.InitLockstep(peer, worldRunner)
+	g.rollback = &RollbackRunner{}
+	g.rollback.Initialize(worldRunner, peer.PlayerIdx()+1, maxFrames)
+	g.checksumFrameIdx = -1
+}
+
 func (g *Gui) Init(worldProxy WorldProxy, worldRunner *WorldRunner,
-	player2Ai *PlayerAI, recordingFile string, painters []string) {
+	ais *PlayerAIs, recordingFile string, simulatePlayer2 bool,
+	painters []string) {
 	if worldProxy == nil {
 		g.fusedMode = true
 	} else {
@@ -982,7 +1209,7 @@ func (g *Gui) Init(worldProxy WorldProxy, worldRunner *WorldRunner,
 
 	g.worldProxy = worldProxy
 	g.worldRunner = worldRunner
-	g.player2Ai = player2Ai
+	g.ais = ais
 
 	g.frameIdx = 0
 	g.targetFrame = -1
@@ -990,7 +1217,13 @@ func (g *Gui) Init(worldProxy WorldProxy, worldRunner *WorldRunner,
 		g.state = GamePaused
 	} else {
 		g.state = Playback
-		g.playerInputs = DeserializeInputs(recordingFile)
+		g.recording = DeserializeRecording(recordingFile)
+		g.worldRunner.InitializePlayback(g.recording)
+		g.snapshots = map[int]playbackSnapshot{}
+		g.player2Source = DefaultPlayer2Source(g.recording)
+		if simulatePlayer2 {
+			g.player2Source = Player2Simulated
+		}
 	}
 
 	g.folderWatcher.Folder = Home("gui-data")
@@ -7,23 +7,47 @@ import (
 	. "playful-patterns.com/bakoko/gui"
 	. "playful-patterns.com/bakoko/proxy"
 	. "playful-patterns.com/bakoko/world"
+	"strconv"
 	"time"
 )
 
 // 3 possible run modes: FusedRecording, FusedPlayback, SplitRecording
 // Run the world in SplitRecording mode.
+// To play:
+// gui-main <world endpoint> <painter endpoint 1> <painter endpoint 2> [slot]
+// To watch others play:
+// gui-main <world endpoint> spectator
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 	//log.SetOutput(io.Discard) // Disable logging.
 
 	var worldProxyTcpIp WorldProxyTcpIp
-	worldProxyTcpIp.Endpoint = os.Args[1] // localhost:56901 or localhost:56902
+	worldProxyTcpIp.Endpoint = os.Args[1] // localhost:56901
 	worldProxyTcpIp.Timeout = 1000 * time.Millisecond
 
+	// Spectators don't get the debug info, the gui of the player who is
+	// already listening for painters does.
+	if os.Args[2] == "spectator" {
+		worldProxyTcpIp.Role = RoleSpectator
+		var g Gui
+		g.InitSpectator(&worldProxyTcpIp, []string{})
+		err := ebiten.RunGame(&g)
+		Check(err)
+		return
+	}
+
+	// Optionally, which player to be (1 or 2). By default, the world gives
+	// us the first free player slot.
+	if len(os.Args) > 4 {
+		slot, err := strconv.Atoi(os.Args[4])
+		Check(err)
+		worldProxyTcpIp.Slot = int64(slot)
+	}
+
 	painters := []string{os.Args[2], os.Args[3]}
 
 	var g Gui
-	g.Init(&worldProxyTcpIp, nil, nil, "", painters)
+	g.Init(&worldProxyTcpIp, nil, nil, "", false, painters)
 
 	// Start the game.
 	err := ebiten.RunGame(&g)
@@ -0,0 +1,25 @@
+// Package worldtest has the small world that the tests of the world and of
+// the packages that run it play in. It doesn't import the world package, so
+// that the tests inside the world package can use it too.
+package worldtest
+
+// The world.json of the test world. There are two players and a few
+// obstacles.
+const WorldJson = `{
+	"BallSpeed": 450, "BallDec": 3, "BallDiameter": 3700,
+	"Player1X": 10000, "Player1Y": 10000, "Player1Speed": 350,
+	"Player1Health": 3, "Player1NBalls": 3, "Player1BallType": 1,
+	"Player1Diameter": 5000,
+	"Player2X": 30000, "Player2Y": 10000, "Player2Speed": 100,
+	"Player2Health": 6, "Player2NBalls": 10, "Player2BallType": 2,
+	"Player2Diameter": 5000, "Player2StunnedImobilizes": true,
+	"ObstacleSize": 4000}`
+
+// The level of the test world.
+const Level = "" +
+	"xxxxxxxxxxx\n" +
+	"x    1    x\n" +
+	"x         x\n" +
+	"x  xx   1 x\n" +
+	"x         x\n" +
+	"xxxxxxxxxxx\n"
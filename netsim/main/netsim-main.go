@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	. "playful-patterns.com/bakoko/netsim"
+	"time"
+)
+
+// Put a bad network between two modules, for example between an AI and the
+// world:
+// netsim-main -latency 100ms -jitter 50ms localhost:56911 localhost:56901
+// ai-main localhost:56911 ...
+// The clients connect to the first endpoint instead of the server, which is
+// at the second endpoint.
+func main() {
+	var c Conditions
+	flag.DurationVar(&c.Latency, "latency", 0,
+		"how long the data takes to get to the other side")
+	flag.DurationVar(&c.Jitter, "jitter", 0,
+		"a random extra latency, up to this much")
+	flag.Int64Var(&c.Bandwidth, "bandwidth", 0,
+		"how many bytes per second get through, 0 means no limit")
+	flag.IntVar(&c.MaxWriteSize, "max-write-size", 0,
+		"write the data in pieces of at most this many bytes, 0 means "+
+			"write it as it comes")
+	flag.DurationVar(&c.PartialWritePause, "partial-write-pause",
+		10*time.Millisecond, "the pause between the pieces of a partial write")
+	flag.DurationVar(&c.DisconnectAfter, "disconnect-after", 0,
+		"cut every connection after this long, 0 means never")
+	flag.Int64Var(&c.DisconnectAfterBytes, "disconnect-after-bytes", 0,
+		"cut every connection after this many bytes, 0 means never")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "the seed of the jitter")
+	flag.Usage = func() {
+		fmt.Println("usage: netsim-main [flags] <endpoint> <upstream>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	s := Simulator{Endpoint: flag.Arg(0), Upstream: flag.Arg(1), Seed: *seed}
+	if err := s.Initialize(c); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("forwarding %s to %s with %+v", s.Addr(), s.Upstream, c)
+	select {}
+}
@@ -0,0 +1,274 @@
+package netsim
+
+import (
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// The modules mostly talk to each other on the same machine, where the
+// network is perfect. Real networks are slow, uneven and they drop
+// connections, and the code that deals with that only runs on real
+// networks. The simulator sits between a client and a server and makes the
+// connection between them as bad as we want, so that this code can run on
+// one machine, in tests or by hand:
+// client <-> simulator (Endpoint) <-> server (Upstream)
+// It works with the bytes on the connection, it doesn't know about
+// messages. So it can cut a message in pieces or cut a connection in the
+// middle of a message, just like a real network.
+
+// Conditions say how bad the network is. They apply to the data going in
+// each direction.
+type Conditions struct {
+	// How long the data takes to get to the other side.
+	Latency time.Duration
+	// A random extra latency between 0 and Jitter. The data still arrives
+	// in the order it was sent, like on a TCP connection.
+	Jitter time.Duration
+	// How many bytes per second get through. 0 means no limit.
+	Bandwidth int64
+	// The data is written to the other side in pieces of at most this many
+	// bytes, with a pause between them, so that the other side reads
+	// partial messages. 0 means the data is written as it was read.
+	MaxWriteSize int
+	// How long to wait between the pieces of a partial write.
+	PartialWritePause time.Duration
+	// Cut the connection after this long. 0 means never.
+	DisconnectAfter time.Duration
+	// Cut the connection after this many bytes went through it, in either
+	// direction. The bytes that don't fit are lost, so the last message is
+	// most likely only partially sent. 0 means never.
+	DisconnectAfterBytes int64
+}
+
+// Simulator accepts clients at Endpoint and connects each of them to
+// Upstream, through a network with the given conditions.
+type Simulator struct {
+	Endpoint string
+	Upstream string
+	// The same seed gives the same jitter, if the data comes at the same
+	// times.
+	Seed int64
+
+	mutex      sync.Mutex
+	conditions Conditions
+	random     *rand.Rand
+	listener   net.Listener
+	links      map[*link]bool
+}
+
+// Initialize starts listening at the endpoint and accepting clients in the
+// background.
+func (s *Simulator) Initialize(c Conditions) error {
+	s.conditions = c
+	s.random = rand.New(rand.NewSource(s.Seed))
+	s.links = map[*link]bool{}
+
+	var err error
+	s.listener, err = net.Listen("tcp", s.Endpoint)
+	if err != nil {
+		return err
+	}
+	go s.acceptClients()
+	return nil
+}
+
+// Addr is the endpoint the simulator actually listens at.
+func (s *Simulator) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops accepting clients and cuts every connection.
+func (s *Simulator) Close() {
+	s.listener.Close()
+	s.Disconnect()
+}
+
+// SetConditions changes the conditions for the data that comes from now on,
+// on the current connections as well. The limits of DisconnectAfter and
+// DisconnectAfterBytes only apply to new connections.
+func (s *Simulator) SetConditions(c Conditions) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.conditions = c
+}
+
+func (s *Simulator) getConditions() Conditions {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.conditions
+}
+
+// Disconnect cuts every connection that goes through the simulator now.
+// Clients can connect again.
+func (s *Simulator) Disconnect() {
+	s.mutex.Lock()
+	links := s.links
+	s.links = map[*link]bool{}
+	s.mutex.Unlock()
+	for l := range links {
+		l.close()
+	}
+}
+
+// NConnections is the number of connections going through the simulator.
+func (s *Simulator) NConnections() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.links)
+}
+
+func (s *Simulator) acceptClients() {
+	for {
+		client, err := s.listener.Accept()
+		if err != nil {
+			// The listener is closed.
+			return
+		}
+		go s.connect(client)
+	}
+}
+
+func (s *Simulator) connect(client net.Conn) {
+	server, err := net.Dial("tcp", s.Upstream)
+	if err != nil {
+		// Like a server that is not there.
+		log.Printf("netsim: can't connect to %s: %v", s.Upstream, err)
+		client.Close()
+		return
+	}
+
+	c := s.getConditions()
+	l := &link{client: client, server: server, maxBytes: c.DisconnectAfterBytes}
+	s.mutex.Lock()
+	s.links[l] = true
+	s.mutex.Unlock()
+
+	if c.DisconnectAfter > 0 {
+		time.AfterFunc(c.DisconnectAfter, func() { s.drop(l) })
+	}
+	go s.forward(l, client, server)
+	go s.forward(l, server, client)
+}
+
+func (s *Simulator) drop(l *link) {
+	s.mutex.Lock()
+	delete(s.links, l)
+	s.mutex.Unlock()
+	l.close()
+}
+
+// A delay for data read now.
+func (s *Simulator) delay(c Conditions) time.Duration {
+	if c.Jitter <= 0 {
+		return c.Latency
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return c.Latency + time.Duration(s.random.Int63n(int64(c.Jitter)+1))
+}
+
+// A client and a server connected through the simulator.
+type link struct {
+	client    net.Conn
+	server    net.Conn
+	closeOnce sync.Once
+	mutex     sync.Mutex
+	maxBytes  int64 // 0 means no limit.
+	nBytes    int64
+}
+
+func (l *link) close() {
+	l.closeOnce.Do(func() {
+		l.client.Close()
+		l.server.Close()
+	})
+}
+
+// How many of n bytes may still go through the link.
+func (l *link) take(n int) int {
+	if l.maxBytes == 0 {
+		return n
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	n = int(min(int64(n), l.maxBytes-l.nBytes))
+	l.nBytes += int64(n)
+	return n
+}
+
+// Data read at a certain time, to be written when its delay passed.
+type chunk struct {
+	data      []byte
+	deliverAt time.Time
+}
+
+// Forward the data from src to dst, under the current conditions, until
+// either side closes.
+func (s *Simulator) forward(l *link, src net.Conn, dst net.Conn) {
+	chunks := make(chan chunk, 1024)
+
+	// Read as soon as the data is there, so that the latency doesn't add
+	// up, and stamp the data with the time it may be delivered.
+	go func() {
+		defer close(chunks)
+		var last time.Time
+		for {
+			buf := make([]byte, 64*1024)
+			n, err := src.Read(buf)
+			if err != nil {
+				return
+			}
+			deliverAt := time.Now().Add(s.delay(s.getConditions()))
+			// Data can't overtake data that was sent before it.
+			if deliverAt.Before(last) {
+				deliverAt = last
+			}
+			last = deliverAt
+			chunks <- chunk{buf[:n], deliverAt}
+		}
+	}()
+
+	defer s.drop(l)
+	for ch := range chunks {
+		time.Sleep(time.Until(ch.deliverAt))
+		if !s.write(l, dst, ch.data) {
+			return
+		}
+	}
+}
+
+// Write the data like a bad network would. Returns false if the link is
+// done.
+func (s *Simulator) write(l *link, dst net.Conn, data []byte) bool {
+	n := l.take(len(data))
+	cut := n < len(data)
+	data = data[:n]
+
+	for len(data) > 0 {
+		c := s.getConditions()
+		size := len(data)
+		if c.MaxWriteSize > 0 {
+			size = min(size, c.MaxWriteSize)
+		}
+		if _, err := dst.Write(data[:size]); err != nil {
+			return false
+		}
+		data = data[size:]
+
+		// Take as long as the bandwidth says, and leave a gap between the
+		// pieces of a partial write.
+		pause := time.Duration(0)
+		if c.Bandwidth > 0 {
+			pause += time.Duration(int64(size) * int64(time.Second) /
+				c.Bandwidth)
+		}
+		if len(data) > 0 {
+			pause += c.PartialWritePause
+		}
+		time.Sleep(pause)
+	}
+	return !cut
+}
@@ -0,0 +1,213 @@
+package netsim
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	. "playful-patterns.com/bakoko/ints"
+	. "playful-patterns.com/bakoko/proxy"
+	. "playful-patterns.com/bakoko/world"
+	"testing"
+	"time"
+)
+
+func startSimulator(t *testing.T, upstream string, c Conditions) *Simulator {
+	s := &Simulator{Endpoint: "localhost:0", Upstream: upstream, Seed: 1}
+	assert.Nil(t, s.Initialize(c))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// An endpoint nobody listens at, for servers that listen on their own.
+func freeEndpoint(t *testing.T) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// ReadData gets whole messages, even if they arrive in pieces, and fails
+// instead of hanging if the connection is cut in the middle of a message.
+func TestReadData_PartialWrites(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	defer l.Close()
+	s := startSimulator(t, l.Addr().String(), Conditions{
+		Latency:              5 * time.Millisecond,
+		MaxWriteSize:         3,
+		PartialWritePause:    time.Millisecond,
+		DisconnectAfterBytes: 100})
+
+	message := make([]byte, 50)
+	for i := range message {
+		message[i] = byte(i)
+	}
+	go func() {
+		conn, err := l.Accept()
+		assert.Nil(t, err)
+		defer conn.Close()
+		// The first message fits, the second one doesn't.
+		assert.Nil(t, WriteData(conn, message, time.Second))
+		assert.Nil(t, WriteData(conn, message, time.Second))
+	}()
+
+	conn, err := net.Dial("tcp", s.Addr())
+	assert.Nil(t, err)
+	defer conn.Close()
+	data, err := ReadData(conn, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, message, data)
+	_, err = ReadData(conn, time.Second)
+	assert.ErrorIs(t, err, ErrClosed)
+}
+
+// A player plays through a slow network, loses the connection and gets its
+// slot back.
+func TestWorldProxy_Reconnect(t *testing.T) {
+	server := WorldServer{Endpoint: "localhost:0", NPlayers: 1}
+	assert.Nil(t, server.Initialize())
+	defer server.Close()
+	s := startSimulator(t, server.Addr(), Conditions{
+		Latency:           10 * time.Millisecond,
+		Jitter:            10 * time.Millisecond,
+		Bandwidth:         100000,
+		MaxWriteSize:      10,
+		PartialWritePause: time.Millisecond})
+	client := WorldProxyTcpIp{Endpoint: s.Addr(), Timeout: time.Second}
+	connect := func() {
+		assert.Eventually(t, func() bool { return client.Connect() == nil },
+			5*time.Second, 10*time.Millisecond)
+	}
+
+	w := World{Players: make([]Player, 2)}
+	w.Players[0].Health = I(3)
+	inputs := make(chan *PlayerInput)
+	sendWorld := func(frameIdx int) {
+		go func() { inputs <- server.Player(1).SendWorldGetInput(&w, frameIdx) }()
+	}
+	play := func(frameIdx int, input PlayerInput) {
+		w2, idx, err := client.GetWorld()
+		assert.Nil(t, err)
+		assert.Equal(t, frameIdx, idx)
+		assert.Equal(t, w.Serialize(), w2.Serialize())
+		assert.Nil(t, client.SendInput(&input, idx))
+		assert.Equal(t, input, *<-inputs)
+	}
+
+	connect()
+	assert.Equal(t, int64(1), client.Slot)
+	sendWorld(0)
+	play(0, PlayerInput{MoveLeft: true})
+	w.Players[0].Health = I(2)
+	sendWorld(1)
+	play(1, PlayerInput{MoveRight: true})
+
+	// The connection is cut while the world waits for our input. Sending it
+	// fails (lost connection (1)), maybe not right away, as the first write
+	// to a dead connection can still succeed.
+	sendWorld(2)
+	_, _, err := client.GetWorld()
+	assert.Nil(t, err)
+	s.Disconnect()
+	assert.Eventually(t, func() bool {
+		err = client.SendInput(&PlayerInput{Shoot: true}, 2)
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NotErrorIs(t, err, ErrNoConnection)
+
+	// The world sends the frame again on the new connection.
+	connect()
+	assert.Equal(t, int64(1), client.Slot)
+	play(2, PlayerInput{Shoot: true})
+
+	// The connection is cut while we wait for the world (lost connection
+	// (3)).
+	sendWorld(3)
+	time.Sleep(50 * time.Millisecond)
+	s.Disconnect()
+	_, _, err = client.GetWorld()
+	for err == nil {
+		// The world may have gotten through before the cut.
+		_, _, err = client.GetWorld()
+	}
+	assert.ErrorIs(t, err, ErrClosed)
+	connect()
+	play(3, PlayerInput{MoveLeft: true})
+
+	// The world takes longer to come than we wait for it.
+	s.SetConditions(Conditions{Latency: 300 * time.Millisecond})
+	client.Timeout = 100 * time.Millisecond
+	sendWorld(4)
+	_, _, err = client.GetWorld()
+	assert.ErrorIs(t, err, ErrTimeout)
+	s.SetConditions(Conditions{})
+	client.Timeout = time.Second
+	connect()
+	play(4, PlayerInput{MoveRight: true})
+}
+
+// The connection to the gui is cut and the painter reconnects to it.
+func TestGuiProxy_PainterProxy_Reconnect(t *testing.T) {
+	painter := PainterProxyTcpIp{Endpoint: freeEndpoint(t)}
+	s := startSimulator(t, painter.Endpoint, Conditions{
+		Latency:           time.Millisecond,
+		MaxWriteSize:      5,
+		PartialWritePause: time.Millisecond})
+	gui := GuiProxyTcpIp{Endpoint: s.Addr()}
+
+	infos := make(chan DebugInfo)
+	getPaintData := func() {
+		go func() { infos <- painter.GetPaintData() }()
+	}
+	// The gui may not be there yet, or may not have noticed that the
+	// connection is gone (lost connection (2)), so keep painting until it
+	// gets something.
+	paint := func(info *DebugInfo) DebugInfo {
+		for {
+			gui.SendPaintData(info)
+			select {
+			case got := <-infos:
+				return got
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}
+
+	var info DebugInfo
+	info.Points = append(info.Points, DebugPoint{Pos: Pt{I(1), I(2)},
+		Size: I(3)})
+	getPaintData()
+	got := paint(&info)
+	assert.Equal(t, info.Serialize(), got.Serialize())
+
+	s.Disconnect()
+	info.Points[0].Size = I(4)
+	getPaintData()
+	got = paint(&info)
+	assert.Equal(t, info.Serialize(), got.Serialize())
+}
+
+// A gui that accepts the connection but never answers the handshake doesn't
+// hold up the world that paints on it.
+func TestGuiProxy_SilentGui(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	gui := GuiProxyTcpIp{Endpoint: l.Addr().String()}
+	var info DebugInfo
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		gui.SendPaintData(&info)
+		time.Sleep(time.Millisecond)
+	}
+	assert.Less(t, time.Since(start), time.Second)
+}
@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	. "playful-patterns.com/bakoko/world"
+)
+
+// Sending the whole world every frame is wasteful. The level (the obstacles
+// and the settings that come with them) doesn't change during a match, and
+// from one frame to the next most balls stay where they are. Over a slow
+// link, this is what makes remote play lag.
+// So only the first world on a connection is sent whole. After that, both
+// ends remember the last world that went through the connection and only
+// what changed since that world is sent:
+// - the level, only when it is not the level of the last world
+// - the players that changed, each with its index
+// - the balls that changed, each with its index
+// The events of the step that made the world are not part of the world
+// state, they are new every frame and follow every message, whole or not.
+// If the receiver doesn't have the world the changes are based on, it can't
+// rebuild the new world. It drops the connection and starts over with a
+// whole world on the next connection.
+
+// What a world message contains.
+const (
+	worldSnapshot byte = iota // The whole world.
+	worldDelta                // What changed since the previous world.
+)
+
+// Which parts of the world a delta contains, besides the balls.
+const (
+	deltaLevel uint8 = 1 << iota
+	deltaDebugInfo
+)
+
+var ErrOutOfSync = errors.New("out of sync")
+
+type changedPlayer struct {
+	Index  int64
+	Player Player
+}
+
+type changedBall struct {
+	Index int64
+	Ball  Ball
+}
+
+// worldEncoder turns the worlds sent over a connection into messages.
+// Every connection needs its own encoder, and a new connection needs a
+// reset encoder.
+type worldEncoder struct {
+	last         *World // nil means the next world is sent whole.
+	lastFrameIdx int
+}
+
+func (e *worldEncoder) Reset() {
+	e.last = nil
+}
+
+func (e *worldEncoder) Encode(w *World, frameIdx int) []byte {
+	buf := new(bytes.Buffer)
+	Serialize(buf, int64(frameIdx))
+	if e.last == nil {
+		Serialize(buf, worldSnapshot)
+		buf.Write(w.Serialize())
+	} else {
+		Serialize(buf, worldDelta)
+		Serialize(buf, int64(e.lastFrameIdx))
+		serializeWorldDelta(buf, e.last, w)
+	}
+	SerializeSlice(buf, w.Events)
+
+	// Keep our own copy, the world keeps changing its own.
+	e.last = copyWorld(w)
+	e.lastFrameIdx = frameIdx
+	return buf.Bytes()
+}
+
+func serializeWorldDelta(buf *bytes.Buffer, old *World, w *World) {
+	var parts uint8
+	if levelChanged(old, w) {
+		parts |= deltaLevel
+	}
+	debugInfo := w.DebugInfo.Serialize()
+	if !bytes.Equal(debugInfo, old.DebugInfo.Serialize()) {
+		parts |= deltaDebugInfo
+	}
+	Serialize(buf, parts)
+
+	if parts&deltaLevel != 0 {
+		w.Obstacles.Serialize(buf)
+		Serialize(buf, w.ObstacleSize)
+		Serialize(buf, w.BallSpeed)
+		Serialize(buf, w.BallDec)
+		Serialize(buf, w.BallDiameter)
+	}
+	// Players that are new are changed as well.
+	var changedPlayers []changedPlayer
+	for i := range w.Players {
+		if i >= len(old.Players) || w.Players[i] != old.Players[i] {
+			changedPlayers = append(changedPlayers,
+				changedPlayer{int64(i), w.Players[i]})
+		}
+	}
+	Serialize(buf, int64(len(w.Players)))
+	SerializeSlice(buf, changedPlayers)
+
+	// Balls that are new are changed as well.
+	var changed []changedBall
+	for i := range w.Balls {
+		if i >= len(old.Balls) || w.Balls[i] != old.Balls[i] {
+			changed = append(changed, changedBall{int64(i), w.Balls[i]})
+		}
+	}
+	Serialize(buf, int64(len(w.Balls)))
+	SerializeSlice(buf, changed)
+
+	Serialize(buf, w.Over)
+	Serialize(buf, w.JustReloaded)
+	if parts&deltaDebugInfo != 0 {
+		buf.Write(debugInfo)
+	}
+}
+
+// The level is compared with the level of the last world sent, instead of
+// sending it when the world was just reloaded. The frame of the reload may
+// never go through a connection, for example when the player is late and
+// skips it.
+func levelChanged(old *World, w *World) bool {
+	if w.ObstacleSize != old.ObstacleSize || w.BallSpeed != old.BallSpeed ||
+		w.BallDec != old.BallDec || w.BallDiameter != old.BallDiameter {
+		return true
+	}
+	var obstacles, oldObstacles bytes.Buffer
+	w.Obstacles.Serialize(&obstacles)
+	old.Obstacles.Serialize(&oldObstacles)
+	return !bytes.Equal(obstacles.Bytes(), oldObstacles.Bytes())
+}
+
+// worldDecoder turns the messages of a worldEncoder back into worlds.
+// Like the encoder, it must be reset for a new connection.
+type worldDecoder struct {
+	last         *World // nil means we can only take a whole world.
+	lastFrameIdx int
+}
+
+func (d *worldDecoder) Reset() {
+	d.last = nil
+}
+
+// Decode fails with ErrOutOfSync if the message has the changes since a
+// world we don't have.
+func (d *worldDecoder) Decode(data []byte) (w *World, frameIdx int, err error) {
+	// The message comes from the network, so it may be wrong. That must
+	// not crash us, it is a malformed message like any other.
+	r := Reader{Buf: bytes.NewBuffer(data)}
+	var idx int64
+	r.Read(&idx)
+	var kind byte
+	r.Read(&kind)
+	if r.Err != nil {
+		return nil, 0, r.Err
+	}
+
+	switch kind {
+	case worldSnapshot:
+		w = &World{}
+		w.Read(&r)
+	case worldDelta:
+		var baseFrameIdx int64
+		r.Read(&baseFrameIdx)
+		if r.Err != nil {
+			return nil, 0, r.Err
+		}
+		if d.last == nil {
+			return nil, 0, fmt.Errorf("%w: got the changes since frame %d, "+
+				"but we have no world", ErrOutOfSync, baseFrameIdx)
+		}
+		if int(baseFrameIdx) != d.lastFrameIdx {
+			return nil, 0, fmt.Errorf("%w: got the changes since frame %d, "+
+				"but we have frame %d", ErrOutOfSync, baseFrameIdx,
+				d.lastFrameIdx)
+		}
+		w = copyWorld(d.last)
+		readWorldDelta(&r, w)
+	default:
+		return nil, 0, fmt.Errorf("%w: unknown world message kind %d",
+			ErrMalformedMessage, kind)
+	}
+	ReadSlice(&r, &w.Events)
+	if r.Err != nil {
+		return nil, 0, r.Err
+	}
+
+	// Keep our own copy, the caller may change the one we return.
+	d.last = copyWorld(w)
+	d.lastFrameIdx = int(idx)
+	return w, int(idx), nil
+}
+
+func readWorldDelta(r *Reader, w *World) {
+	var parts uint8
+	r.Read(&parts)
+
+	if parts&deltaLevel != 0 {
+		w.Obstacles.Read(r)
+		r.Read(&w.ObstacleSize)
+		r.Read(&w.BallSpeed)
+		r.Read(&w.BallDec)
+		r.Read(&w.BallDiameter)
+	}
+	nPlayers := r.ReadLen(0)
+	var changedPlayers []changedPlayer
+	ReadSlice(r, &changedPlayers)
+	checkDeltaLen(r, nPlayers, len(w.Players), len(changedPlayers))
+	if r.Err != nil {
+		return
+	}
+	w.Players = resize(w.Players, nPlayers)
+	for _, c := range changedPlayers {
+		if !checkDeltaIndex(r, c.Index, len(w.Players)) {
+			return
+		}
+		w.Players[c.Index] = c.Player
+	}
+
+	nBalls := r.ReadLen(0)
+	var changed []changedBall
+	ReadSlice(r, &changed)
+	checkDeltaLen(r, nBalls, len(w.Balls), len(changed))
+	if r.Err != nil {
+		return
+	}
+	w.Balls = resize(w.Balls, nBalls)
+	for _, c := range changed {
+		if !checkDeltaIndex(r, c.Index, len(w.Balls)) {
+			return
+		}
+		w.Balls[c.Index] = c.Ball
+	}
+
+	r.Read(&w.Over)
+	r.Read(&w.JustReloaded)
+	if parts&deltaDebugInfo != 0 {
+		w.DebugInfo.Read(r)
+	}
+}
+
+// New players and balls are always changed ones, so a delta can't make the
+// world have more of them than it had plus the changed ones. A bigger length
+// would only make us allocate for nothing.
+func checkDeltaLen(r *Reader, n int64, oldLen int, nChanged int) {
+	if r.Err == nil && n > int64(oldLen+nChanged) {
+		r.Err = fmt.Errorf("%w: %d elements after a delta with %d changes "+
+			"to %d elements", ErrMalformedMessage, n, nChanged, oldLen)
+	}
+}
+
+// A change can only be for an element that the world has after the delta.
+func checkDeltaIndex(r *Reader, idx int64, n int) bool {
+	if idx < 0 || idx >= int64(n) {
+		r.Err = fmt.Errorf("%w: a change to element %d of %d",
+			ErrMalformedMessage, idx, n)
+		return false
+	}
+	return true
+}
+
+func resize[T any](s []T, n int64) []T {
+	if n == 0 {
+		// Like a whole world without any.
+		return nil
+	} else if n <= int64(len(s)) {
+		return s[:n]
+	}
+	return append(s, make([]T, n-int64(len(s)))...)
+}
@@ -2,7 +2,6 @@ package proxy
 
 import (
 	"log"
-	"net"
 	. "playful-patterns.com/bakoko/world"
 	"time"
 )
@@ -27,21 +26,32 @@ func (p *GuiProxyRegular) SendPaintData(debugInfo *DebugInfo) {
 // world.
 // This is a client that connects to a server.
 type GuiProxyTcpIp struct {
-	Endpoint string
-	conn     net.Conn
+	Endpoint  string
+	Transport Transport // nil means TCP/IP.
+	conn      Conn
+	// Gets the connection when connecting in the background is done, or nil
+	// if it failed.
+	connecting chan Conn
 }
 
 // Try to send an input to the peer, but don't block.
 func (p *GuiProxyTcpIp) SendPaintData(debugInfo *DebugInfo) {
-	// If we don't have a peer, connect to one.
+	// If we don't have a peer, connect to one. A gui that accepts us but
+	// takes its time to say hello would stop the world for as long as the
+	// handshake takes, so connect in the background and drop the paint data
+	// until we are connected.
 	if p.conn == nil {
-		var err error
-		p.conn, err = net.DialTimeout("tcp", p.Endpoint, 5*time.Millisecond)
-
-		// If connection took too long or failed, screw it.
-		// We'll try again later.
-		if err != nil {
-			//log.Println("could not connect!")
+		if p.connecting == nil {
+			p.connecting = make(chan Conn, 1)
+			go connectToGui(getTransport(p.Transport), p.Endpoint,
+				p.connecting)
+		}
+		select {
+		case p.conn = <-p.connecting:
+			p.connecting = nil
+		default:
+		}
+		if p.conn == nil {
 			return
 		}
 	}
@@ -50,12 +60,59 @@ func (p *GuiProxyTcpIp) SendPaintData(debugInfo *DebugInfo) {
 	// We have a connection, try to send our input.
 	data := debugInfo.Serialize()
 
-	err := WriteData(p.conn, data, 0)
+	err := p.conn.WriteMessage(data, 0)
 	// If there was an error, assume the peer is no longer available.
 	// Invalidate the connection and try again later.
 	if err != nil {
 		p.conn.Close()
 		p.conn = nil
-		log.Println("lost connection (2)")
+		log.Println("lost connection (2):", err)
+	}
+}
+
+func connectToGui(transport Transport, endpoint string, done chan<- Conn) {
+	conn, err := transport.Dial(endpoint, 5*time.Millisecond)
+
+	// If connection took too long or failed, screw it.
+	// We'll try again later.
+	if err != nil {
+		//log.Println("could not connect!")
+		done <- nil
+		return
+	}
+
+	// The gui is there, tell it we are a painter.
+	_, err = ClientHandshake(conn, RolePainter, 0, HandshakeTimeout)
+	if err != nil {
+		log.Println(err)
+		conn.Close()
+		done <- nil
+		return
+	}
+	done <- conn
+}
+
+// PaintChannel connects a GuiProxyChan with a PainterProxyChan, so that a
+// painter and the gui can run in the same process without TCP/IP.
+type PaintChannel struct {
+	infos chan DebugInfo
+}
+
+func (c *PaintChannel) Initialize() {
+	c.infos = make(chan DebugInfo, 1)
+}
+
+// This is the same as GuiProxyTcpIp, except it talks to a PainterProxyChan
+// through a PaintChannel.
+type GuiProxyChan struct {
+	Channel *PaintChannel
+}
+
+// Try to send the paint data, but don't block. If the gui didn't take the
+// previous paint data yet, this one is dropped.
+func (p *GuiProxyChan) SendPaintData(debugInfo *DebugInfo) {
+	select {
+	case p.Channel.infos <- debugInfo.Clone():
+	default:
 	}
 }
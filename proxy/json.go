@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	. "playful-patterns.com/bakoko/ints"
+	. "playful-patterns.com/bakoko/world"
+)
+
+// Bots don't have to be written in Go. A bot written in any language can
+// connect to the JSON endpoint of the world server, where every message is
+// one line of JSON:
+// - the bot sends a Handshake and gets a HandshakeReply, like everyone else
+// - the world sends a JsonWorld, the whole world every frame
+// - a player answers with a JsonInput for the same frame
+// For example, a player that always moves left:
+// > {"ProtocolVersion":5,"Role":"player","Slot":0}
+// < {"Accepted":true,"Reason":"","ProtocolVersion":5,"BuildHash":"","Slot":2}
+// < {"Frame":0,"You":2,"Players":[...],"Balls":[...],...}
+// > {"Frame":0,"MoveLeft":true}
+// Fields that a JsonInput leaves out are false or 0. Fields it has that we
+// don't know are an error, so that a typo doesn't go unnoticed.
+// All the numbers are the integers the simulation works with.
+
+type JsonPt struct {
+	X int64
+	Y int64
+}
+
+type JsonPlayer struct {
+	Pos               JsonPt
+	Diameter          int64
+	NBalls            int64
+	BallType          int64
+	Health            int64
+	Speed             int64
+	Stunned           bool
+	StunnedImobilizes bool
+	StunnedTime       int64
+	// Players of the same team are on the same side. 0 means the player
+	// is on its own.
+	Team int64
+}
+
+type JsonBall struct {
+	Type           int64
+	Pos            JsonPt
+	Diameter       int64
+	MoveDir        JsonPt
+	Speed          int64
+	CanBeCollected bool
+}
+
+// JsonEvent is an Event. Type is the name of the EventType, like
+// "PlayerHit".
+type JsonEvent struct {
+	Type     string
+	Player   int64
+	BallType int64
+	Pos      JsonPt
+}
+
+type JsonWorld struct {
+	Frame int64
+	// The slot of the player that gets the world (1 is Players[0]), 0 for
+	// spectators.
+	You     int64
+	Players []JsonPlayer
+	Balls   []JsonBall
+	// The level is a grid of squares of ObstacleSize, by rows. A cell is 0
+	// if it has no obstacle.
+	Obstacles    [][]int64
+	ObstacleSize int64
+	BallSpeed    int64
+	BallDec      int64
+	BallDiameter int64
+	Over         bool
+	JustReloaded bool
+	// What happened in the step that made this world. Player is an index
+	// in Players, -1 if no player was involved.
+	Events []JsonEvent
+}
+
+// JsonInput is a PlayerInput for a frame.
+type JsonInput struct {
+	Frame     int64
+	MoveLeft  bool
+	MoveRight bool
+	MoveUp    bool
+	MoveDown  bool
+	Shoot     bool
+	ShootPt   JsonPt
+	Quit      bool
+	Reload    bool
+	Pause     bool
+}
+
+func jsonPt(pt Pt) JsonPt {
+	return JsonPt{pt.X.ToInt64(), pt.Y.ToInt64()}
+}
+
+func jsonPlayer(p Player) JsonPlayer {
+	return JsonPlayer{
+		Pos:               jsonPt(p.Bounds.Center),
+		Diameter:          p.Bounds.Diameter.ToInt64(),
+		NBalls:            p.NBalls.ToInt64(),
+		BallType:          p.BallType.ToInt64(),
+		Health:            p.Health.ToInt64(),
+		Speed:             p.Speed.ToInt64(),
+		Stunned:           p.State.Eq(PlayerStunned),
+		StunnedImobilizes: p.StunnedImobilizes,
+		StunnedTime:       p.StunnedTime.ToInt64(),
+		Team:              p.Team.ToInt64(),
+	}
+}
+
+func marshalJsonWorld(w *World, frameIdx int, you int) []byte {
+	jw := JsonWorld{
+		Frame:        int64(frameIdx),
+		You:          int64(you),
+		Players:      []JsonPlayer{},
+		Balls:        []JsonBall{},
+		Obstacles:    [][]int64{},
+		ObstacleSize: w.ObstacleSize.ToInt64(),
+		BallSpeed:    w.BallSpeed.ToInt64(),
+		BallDec:      w.BallDec.ToInt64(),
+		BallDiameter: w.BallDiameter.ToInt64(),
+		Over:         w.Over.Eq(ONE),
+		JustReloaded: w.JustReloaded.Eq(ONE),
+		Events:       []JsonEvent{},
+	}
+	for _, p := range w.Players {
+		jw.Players = append(jw.Players, jsonPlayer(p))
+	}
+	for _, b := range w.Balls {
+		jw.Balls = append(jw.Balls, JsonBall{
+			Type:           b.Type.ToInt64(),
+			Pos:            jsonPt(b.Bounds.Center),
+			Diameter:       b.Bounds.Diameter.ToInt64(),
+			MoveDir:        jsonPt(b.MoveDir),
+			Speed:          b.Speed.ToInt64(),
+			CanBeCollected: b.CanBeCollected,
+		})
+	}
+	for _, e := range w.Events {
+		jw.Events = append(jw.Events, JsonEvent{
+			Type:     e.Type.String(),
+			Player:   e.Player,
+			BallType: e.BallType.ToInt64(),
+			Pos:      jsonPt(e.Pos),
+		})
+	}
+	for row := ZERO; row.Lt(w.Obstacles.NRows()); row.Inc() {
+		cells := []int64{}
+		for col := ZERO; col.Lt(w.Obstacles.NCols()); col.Inc() {
+			cells = append(cells, w.Obstacles.Get(row, col).ToInt64())
+		}
+		jw.Obstacles = append(jw.Obstacles, cells)
+	}
+
+	data, err := json.Marshal(jw)
+	Check(err)
+	return data
+}
+
+func unmarshalJsonInput(data []byte) (input PlayerInput, frameIdx int,
+	err error) {
+	var ji JsonInput
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&ji); err != nil {
+		return input, 0, fmt.Errorf("%w: %w", ErrMalformedMessage, err)
+	}
+	input = PlayerInput{
+		MoveLeft:  ji.MoveLeft,
+		MoveRight: ji.MoveRight,
+		MoveUp:    ji.MoveUp,
+		MoveDown:  ji.MoveDown,
+		Shoot:     ji.Shoot,
+		ShootPt:   Pt{I64(ji.ShootPt.X), I64(ji.ShootPt.Y)},
+		Quit:      ji.Quit,
+		Reload:    ji.Reload,
+		Pause:     ji.Pause,
+	}
+	return input, int(ji.Frame), nil
+}
+
+// jsonConn is a connection to a client of the JSON endpoint. It carries the
+// same messages as any other connection, only they are written differently.
+type jsonConn struct {
+	Conn
+}
+
+func isJsonConn(conn Conn) bool {
+	_, ok := conn.(*jsonConn)
+	return ok
+}
@@ -0,0 +1,303 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	. "playful-patterns.com/bakoko/world"
+	"time"
+)
+
+// In lockstep mode there is no world-main. Each player runs its own world
+// and the two worlds stay the same because the simulation is deterministic:
+// both start from the same seed and config, and both are stepped with the
+// same inputs. So the players only need to exchange their inputs.
+// An input takes time to get to the other player, so inputs are delayed:
+// the input given in frame F is used in frame F+InputDelay. If the input of
+// the other player arrives before then, nobody waits. If it doesn't, both
+// worlds wait for it, as they can't step without it.
+// If the worlds drift apart anyway (a bug, different builds), the game is
+// over, it can't be repaired. To notice it, every input carries the checksum
+// of the world it reacts to, which the other player compares with its own.
+// In rollback mode, nobody waits for anyone. The players exchange inputs
+// the same way, but each world guesses the inputs of the other player and
+// goes back to fix the frames it guessed wrong (see RollbackRunner). Only
+// the worlds that had no guesses in them are compared.
+
+// LockstepSetup is what both worlds must agree on before the first frame.
+// The host decides it.
+type LockstepSetup struct {
+	Seed   int64
+	Config WorldConfig
+	// Only used in lockstep mode. In rollback mode, an input is used in the
+	// frame it is given in.
+	InputDelay int64
+	// How many frames a world may run ahead of the inputs of the other
+	// player, in rollback mode. 0 means lockstep mode.
+	Rollback int64
+}
+
+var ErrDesync = errors.New("desync")
+
+// LockstepPeer is the other player, for a player in lockstep mode.
+type LockstepPeer struct {
+	Endpoint  string
+	Transport Transport // nil means TCP/IP.
+	// The host listens for the other player to connect and decides the
+	// setup. The host is player 1, the other player is player 2.
+	Host bool
+	// How long Step waits for the input of the other player. 0 means wait
+	// as long as it takes.
+	Timeout time.Duration
+
+	conn  Conn
+	setup LockstepSetup
+	// The inputs and checksums of each player (0 is player 1), by frame.
+	// They are deleted once they are used. Our checksum for a frame also
+	// says that we already sent our input in that frame.
+	// The inputs of both players are only kept in lockstep mode.
+	inputs    [2]map[int]PlayerInput
+	checksums [2]map[int]uint64
+	// The checksums come in the order of their frames. This is the frame of
+	// the last one, for each player.
+	newestChecksum [2]int
+	received       chan lockstepMessage
+	readErr        chan error
+}
+
+// The input of a player for a frame, and the checksum of a world the
+// player was in. There is no checksum if ChecksumFrameIdx is negative.
+type lockstepMessage struct {
+	FrameIdx         int64
+	Input            PlayerInput
+	ChecksumFrameIdx int64
+	Checksum         uint64
+}
+
+// Connect blocks until the two players are connected and returns the setup
+// of the host, which both worlds must be initialized with. Only the setup
+// of the host matters, the setup given by the other player is ignored.
+func (p *LockstepPeer) Connect(setup LockstepSetup) (LockstepSetup, error) {
+	if p.Host {
+		p.conn = acceptOne(getTransport(p.Transport), p.Endpoint, RolePeer)
+		data, err := json.Marshal(setup)
+		Check(err)
+		if err = p.conn.WriteMessage(data, HandshakeTimeout); err != nil {
+			p.conn.Close()
+			return setup, err
+		}
+	} else {
+		conn, err := getTransport(p.Transport).Dial(p.Endpoint, p.Timeout)
+		if err != nil {
+			return setup, err
+		}
+		if _, err = ClientHandshake(conn, RolePeer, 0, HandshakeTimeout); err != nil {
+			conn.Close()
+			return setup, err
+		}
+		data, err := conn.ReadMessage(HandshakeTimeout)
+		if err != nil {
+			conn.Close()
+			return setup, err
+		}
+		if err = json.Unmarshal(data, &setup); err != nil {
+			conn.Close()
+			return setup, &TransportError{Op: "read", Endpoint: p.Endpoint,
+				Err: fmt.Errorf("%w: %w", ErrMalformedMessage, err)}
+		}
+		p.conn = conn
+	}
+	p.setup = setup
+
+	// Nobody gives inputs for the frames before the first input arrives.
+	for i := range p.inputs {
+		p.inputs[i] = map[int]PlayerInput{}
+		p.checksums[i] = map[int]uint64{}
+		p.newestChecksum[i] = -1
+		for frameIdx := 0; frameIdx < int(setup.InputDelay); frameIdx++ {
+			p.inputs[i][frameIdx] = PlayerInput{}
+		}
+	}
+
+	// Reading with a timeout may leave half a message unread, so only read
+	// in the background, and only wait for what was read with a timeout.
+	p.received = make(chan lockstepMessage, 100)
+	p.readErr = make(chan error, 1)
+	go p.readMessages(p.conn)
+	return setup, nil
+}
+
+func (p *LockstepPeer) Close() {
+	if p.conn != nil {
+		p.conn.Close()
+	}
+}
+
+func (p *LockstepPeer) readMessages(conn Conn) {
+	for {
+		data, err := conn.ReadMessage(0)
+		if err != nil {
+			p.readErr <- err
+			return
+		}
+		// A message we can't read ends the game like a lost connection,
+		// the peer sent something wrong and we can't trust it anymore.
+		var m lockstepMessage
+		r := Reader{Buf: bytes.NewBuffer(data)}
+		r.Read(&m)
+		if r.Err != nil {
+			p.readErr <- &TransportError{Op: "read", Endpoint: p.Endpoint,
+				Err: r.Err}
+			return
+		}
+		p.received <- m
+	}
+}
+
+// PlayerIdx is the index in World.Players of the player we play.
+func (p *LockstepPeer) PlayerIdx() int {
+	us, _ := p.players()
+	return us
+}
+
+// Which player we are and which player the peer is.
+func (p *LockstepPeer) players() (us int, them int) {
+	if p.Host {
+		return 0, 1
+	}
+	return 1, 0
+}
+
+// Step gives the peer our input for the frame and returns the inputs of
+// both players to step the frame with. The checksum is that of the world
+// we are in, before the step.
+// If the input of the other player doesn't arrive in time, ok is false and
+// the frame must not be stepped yet. Step must be called again for the same
+// frame, but the input we give is only sent the first time.
+// Step fails with ErrDesync if the worlds are not the same anymore.
+func (p *LockstepPeer) Step(input PlayerInput, frameIdx int,
+	checksum uint64) (inputs Input, ok bool, err error) {
+	us, them := p.players()
+
+	// Send our input, unless we already did.
+	if _, sent := p.checksums[us][frameIdx]; !sent {
+		target := frameIdx + int(p.setup.InputDelay)
+		p.inputs[us][target] = input
+		if err = p.SendInput(input, target, frameIdx, checksum); err != nil {
+			return inputs, false, err
+		}
+	}
+
+	// Wait for the input of the other player.
+	timeout := TimeoutChan(p.Timeout)
+	for {
+		if _, arrived := p.inputs[them][frameIdx]; arrived {
+			break
+		}
+		select {
+		case m := <-p.received:
+			p.inputs[them][int(m.FrameIdx)] = m.Input
+			p.receiveChecksum(m)
+		case err = <-p.readErr:
+			// Whoever calls Step again gets the same error.
+			p.readErr <- err
+			return inputs, false, err
+		case <-timeout:
+			return inputs, false, nil
+		}
+	}
+
+	if err = p.compareChecksums(); err != nil {
+		return inputs, false, err
+	}
+
+	inputs.Players = []PlayerInput{p.inputs[0][frameIdx],
+		p.inputs[1][frameIdx]}
+	delete(p.inputs[0], frameIdx)
+	delete(p.inputs[1], frameIdx)
+	return inputs, true, nil
+}
+
+// SendInput gives the peer our input for a frame, without waiting for
+// anything. Along with it goes the checksum of the world we had in another
+// frame, if checksumFrameIdx is not negative.
+func (p *LockstepPeer) SendInput(input PlayerInput, frameIdx int,
+	checksumFrameIdx int, checksum uint64) error {
+	if checksumFrameIdx >= 0 {
+		us, _ := p.players()
+		p.checksums[us][checksumFrameIdx] = checksum
+		p.newestChecksum[us] = checksumFrameIdx
+	}
+	m := lockstepMessage{int64(frameIdx), input, int64(checksumFrameIdx),
+		checksum}
+	buf := new(bytes.Buffer)
+	Serialize(buf, m)
+	// Writes don't time out, as a write deadline would also cut short the
+	// read going on in the background.
+	return p.conn.WriteMessage(buf.Bytes(), 0)
+}
+
+// FrameInput is the input of a player for a frame.
+type FrameInput struct {
+	FrameIdx int
+	Input    PlayerInput
+}
+
+// ReceiveInputs returns the inputs the other player sent since the last
+// call, in the order of their frames, without waiting for anything.
+// It fails with ErrDesync if the worlds are not the same anymore.
+func (p *LockstepPeer) ReceiveInputs() (inputs []FrameInput, err error) {
+	for {
+		select {
+		case m := <-p.received:
+			inputs = append(inputs, FrameInput{int(m.FrameIdx), m.Input})
+			p.receiveChecksum(m)
+		case err = <-p.readErr:
+			p.readErr <- err
+			return nil, err
+		default:
+			return inputs, p.compareChecksums()
+		}
+	}
+}
+
+func (p *LockstepPeer) receiveChecksum(m lockstepMessage) {
+	if m.ChecksumFrameIdx >= 0 {
+		_, them := p.players()
+		p.checksums[them][int(m.ChecksumFrameIdx)] = m.Checksum
+		p.newestChecksum[them] = int(m.ChecksumFrameIdx)
+	}
+}
+
+// Compare the checksums of the frames both players were in so far. The
+// other player may be a few frames ahead or behind, so a checksum waits
+// until the other one is there.
+func (p *LockstepPeer) compareChecksums() error {
+	us, them := p.players()
+	for frameIdx, checksum := range p.checksums[them] {
+		ours, ok := p.checksums[us][frameIdx]
+		if !ok {
+			continue // We are not there yet.
+		}
+		if ours != checksum {
+			return fmt.Errorf("%w: in frame %d our world has checksum %x, "+
+				"the world of the other player has checksum %x", ErrDesync,
+				frameIdx, ours, checksum)
+		}
+		delete(p.checksums[us], frameIdx)
+		delete(p.checksums[them], frameIdx)
+	}
+
+	// In rollback mode, a player doesn't send a checksum for every frame.
+	// If one player sent a checksum for a later frame, the other one will
+	// never be compared.
+	for player, other := range []int{1, 0} {
+		for frameIdx := range p.checksums[player] {
+			if frameIdx < p.newestChecksum[other] {
+				delete(p.checksums[player], frameIdx)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"bytes"
+	"log"
+	. "playful-patterns.com/bakoko/world"
+)
+
+// Every world that is sent says which frame it is, and every input that
+// comes back says which frame it reacts to. This way an input computed for
+// an old world (for example, one received before a reconnect) is never
+// applied to a newer world.
+// Worlds are written by a worldEncoder, see delta.go.
+
+func serializeInputMessage(input *PlayerInput, frameIdx int) []byte {
+	buf := new(bytes.Buffer)
+	Serialize(buf, int64(frameIdx))
+	Serialize(buf, input)
+	return buf.Bytes()
+}
+
+// The message comes from the network, so it fails with ErrMalformedMessage
+// instead of panicking if it is wrong.
+func deserializeInputMessage(data []byte) (input PlayerInput, frameIdx int,
+	err error) {
+	r := Reader{Buf: bytes.NewBuffer(data)}
+	var idx int64
+	r.Read(&idx)
+	r.Read(&input)
+	return input, int(idx), r.Err
+}
+
+// Read inputs until we get the one for the frame. Inputs for other frames
+// are stale and thrown away.
+func readInputForFrame(conn Conn, frameIdx int, name string) (*PlayerInput, error) {
+	for {
+		data, err := conn.ReadMessage(0)
+		if err != nil {
+			return nil, err
+		}
+		var input PlayerInput
+		var inputFrameIdx int
+		if isJsonConn(conn) {
+			input, inputFrameIdx, err = unmarshalJsonInput(data)
+		} else {
+			input, inputFrameIdx, err = deserializeInputMessage(data)
+		}
+		if err != nil {
+			log.Printf("%s sent an input we can't read: %v", name, err)
+			return nil, &TransportError{Op: "read", Err: err}
+		}
+		if inputFrameIdx == frameIdx {
+			return &input, nil
+		}
+		log.Printf("%s sent an input for frame %d while we wait for frame "+
+			"%d, discarding it", name, inputFrameIdx, frameIdx)
+	}
+}
@@ -2,7 +2,7 @@ package proxy
 
 import (
 	"bytes"
-	"net"
+	"log"
 	. "playful-patterns.com/bakoko/world"
 )
 
@@ -27,8 +27,9 @@ func (p *PainterProxyRegular) GetPaintData() (info DebugInfo) {
 // and the AI.
 // This is a server that waits for a painter to connect to it.
 type PainterProxyTcpIp struct {
-	Endpoint string
-	conn     net.Conn
+	Endpoint  string
+	Transport Transport // nil means TCP/IP.
+	conn      Conn
 }
 
 func (p *PainterProxyTcpIp) GetPaintData() (info DebugInfo) {
@@ -36,19 +37,12 @@ func (p *PainterProxyTcpIp) GetPaintData() (info DebugInfo) {
 	for {
 		// If we don't have a peer, wait until we get one.
 		if p.conn == nil {
-			// Listen for incoming connections
-			listener, err := net.Listen("tcp", p.Endpoint)
-			Check(err)
-
-			// Accept one incoming connection.
-			p.conn, err = listener.Accept()
-			Check(err)
-
-			listener.Close()
+			p.conn = acceptOne(getTransport(p.Transport), p.Endpoint,
+				RolePainter)
 		}
 
 		// Try to get data from our peer.
-		data, err := ReadData(p.conn, 0)
+		data, err := p.conn.ReadMessage(0)
 		if err != nil {
 			// There was an error. Nevermind, close the connection and wait
 			// for a new one.
@@ -57,8 +51,26 @@ func (p *PainterProxyTcpIp) GetPaintData() (info DebugInfo) {
 			continue // Wait for a peer again.
 		}
 
-		// Finally, we can return the input.
-		info.Deserialize(bytes.NewBuffer(data))
+		// Finally, we can return the input. If we can't read it, the peer
+		// is not one we can talk to.
+		r := Reader{Buf: bytes.NewBuffer(data)}
+		info.Read(&r)
+		if r.Err != nil {
+			log.Printf("got paint data we can't read: %v", r.Err)
+			p.conn.Close()
+			p.conn = nil
+			continue
+		}
 		return
 	}
 }
+
+// This is the same as PainterProxyTcpIp, except it talks to a GuiProxyChan
+// through a PaintChannel.
+type PainterProxyChan struct {
+	Channel *PaintChannel
+}
+
+func (p *PainterProxyChan) GetPaintData() (info DebugInfo) {
+	return <-p.Channel.infos
+}
@@ -1,8 +1,7 @@
 package proxy
 
 import (
-	"bytes"
-	"net"
+	"log"
 	. "playful-patterns.com/bakoko/world"
 )
 
@@ -10,7 +9,8 @@ type PlayerProxy interface {
 	// Should block until both have happened for the same player:
 	// - the world has been sent successfully
 	// - the reaction has been received successfully
-	SendWorldGetInput(w *World) *PlayerInput
+	// The reaction is for this frame, never for an older one.
+	SendWorldGetInput(w *World, frameIdx int) *PlayerInput
 }
 
 // This is an object that represents a Player.
@@ -22,8 +22,10 @@ type PlayerProxy interface {
 // This is meant to be used by the world which talks to to players.
 // This is a server that waits for a Player to connect to it.
 type PlayerProxyTcpIp struct {
-	Endpoint string
-	conn     net.Conn
+	Endpoint  string
+	Transport Transport // nil means TCP/IP.
+	conn      Conn
+	encoder   worldEncoder
 }
 
 // We want to:
@@ -33,25 +35,20 @@ type PlayerProxyTcpIp struct {
 // If the player disconnects, we must start the process over from the beginning.
 // We don't send the world to one connection and get the reaction from another
 // connection.
-func (p *PlayerProxyTcpIp) SendWorldGetInput(w *World) *PlayerInput {
+func (p *PlayerProxyTcpIp) SendWorldGetInput(w *World, frameIdx int) *PlayerInput {
 	// Keep trying to perform the transaction.
 	for {
 		// If we don't have a peer, wait until we get one.
 		if p.conn == nil {
-			// Listen for incoming connections
-			listener, err := net.Listen("tcp", p.Endpoint)
-			Check(err)
-
-			// Accept one incoming connection.
-			p.conn, err = listener.Accept()
-			Check(err)
-
-			listener.Close()
+			p.conn = acceptOne(getTransport(p.Transport), p.Endpoint,
+				RolePlayer)
+			// The new peer has no world yet.
+			p.encoder.Reset()
 		}
 
 		// Try sending the world to our peer.
-		data := w.Serialize()
-		if err := WriteData(p.conn, data, 0); err != nil {
+		data := p.encoder.Encode(w, frameIdx)
+		if err := p.conn.WriteMessage(data, 0); err != nil {
 			// There was an error. Nevermind, close the connection and wait
 			// for a new one.
 			p.conn.Close()
@@ -60,7 +57,7 @@ func (p *PlayerProxyTcpIp) SendWorldGetInput(w *World) *PlayerInput {
 		}
 
 		// Try to get data from our peer.
-		data, err := ReadData(p.conn, 0)
+		input, err := readInputForFrame(p.conn, frameIdx, "the player")
 		if err != nil {
 			// There was an error. Nevermind, close the connection and wait
 			// for a new one.
@@ -70,8 +67,55 @@ func (p *PlayerProxyTcpIp) SendWorldGetInput(w *World) *PlayerInput {
 		}
 
 		// Finally, we can return the input.
-		var input PlayerInput
-		Deserialize(bytes.NewBuffer(data), &input)
-		return &input
+		return input
 	}
 }
+
+// PlayerChannel connects a PlayerProxyChan with a WorldProxyChan, so that
+// the world and a player can run in the same process without TCP/IP.
+type PlayerChannel struct {
+	worlds chan frameWorld
+	inputs chan frameInput
+}
+
+type frameWorld struct {
+	w        *World
+	frameIdx int
+}
+
+type frameInput struct {
+	input    PlayerInput
+	frameIdx int
+}
+
+func (c *PlayerChannel) Initialize() {
+	c.worlds = make(chan frameWorld, 1)
+	c.inputs = make(chan frameInput, 1)
+}
+
+// This is the same as PlayerProxyTcpIp, except it talks to a WorldProxyChan
+// through a PlayerChannel.
+type PlayerProxyChan struct {
+	Channel *PlayerChannel
+}
+
+func (p *PlayerProxyChan) SendWorldGetInput(w *World, frameIdx int) *PlayerInput {
+	// The player gets its own copy of the world, just like it would get
+	// over the network, so that the world can keep changing its own.
+	p.Channel.worlds <- frameWorld{copyWorld(w), frameIdx}
+	for {
+		input := <-p.Channel.inputs
+		if input.frameIdx == frameIdx {
+			return &input.input
+		}
+		log.Printf("the player sent an input for frame %d while we wait "+
+			"for frame %d, discarding it", input.frameIdx, frameIdx)
+	}
+}
+
+// The events are not part of a serialized world, but the player must get
+// them too.
+func copyWorld(w *World) *World {
+	c := w.Clone()
+	return &c
+}
@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	. "playful-patterns.com/bakoko/world"
+	"sync"
+)
+
+// SendWorldGetInputs sends the world to all players at the same time and
+// waits for all of them to react. This way a frame takes as long as the
+// slowest player, not as long as all players added up, and every player
+// gets the world at the same time.
+// The inputs are in the same order as the players, no matter who answers
+// first, so the world steps the same way every time.
+// The world must not change until this returns.
+func SendWorldGetInputs(w *World, frameIdx int,
+	players ...PlayerProxy) []PlayerInput {
+	inputs := make([]PlayerInput, len(players))
+	var wg sync.WaitGroup
+	for i := range players {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			inputs[i] = *players[i].SendWorldGetInput(w, frameIdx)
+		}(i)
+	}
+	wg.Wait()
+	return inputs
+}
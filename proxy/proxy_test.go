@@ -0,0 +1,914 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"playful-patterns.com/bakoko/internal/worldtest"
+	. "playful-patterns.com/bakoko/ints"
+	. "playful-patterns.com/bakoko/world"
+	. "playful-patterns.com/bakoko/world/world-run"
+	"testing"
+	"time"
+)
+
+func testWorldConfig() WorldConfig {
+	return WorldConfig{WorldJson: worldtest.WorldJson, Level: worldtest.Level}
+}
+
+// The world and a player talk to each other through their proxies, without
+// a real network.
+func TestPlayerProxy_WorldProxy(t *testing.T) {
+	var transport MemoryTransport
+	player := PlayerProxyTcpIp{Endpoint: "player", Transport: &transport}
+	world := WorldProxyTcpIp{Endpoint: "player", Timeout: time.Second,
+		Transport: &transport}
+
+	w := World{Players: make([]Player, 2)}
+	w.Players[0].Health = I(3)
+	var input PlayerInput
+	input.MoveLeft = true
+	input.ShootPt = Pt{I(1), I(2)}
+
+	// The player side.
+	go func() {
+		for world.Connect() != nil {
+			time.Sleep(time.Millisecond)
+		}
+
+		// Like a player that reconnected and still has an input for a world
+		// from the previous connection.
+		assert.Nil(t, world.SendInput(&PlayerInput{Shoot: true}, 3))
+
+		w2, frameIdx, err := world.GetWorld()
+		assert.Nil(t, err)
+		assert.Equal(t, 7, frameIdx)
+		assert.Equal(t, I(3), w2.Players[0].Health)
+		assert.Nil(t, world.SendInput(&input, frameIdx))
+	}()
+
+	// The world side.
+	assert.Equal(t, input, *player.SendWorldGetInput(&w, 7))
+}
+
+func TestWorldProxy_NoConnection(t *testing.T) {
+	world := WorldProxyTcpIp{Endpoint: "nobody", Transport: &MemoryTransport{}}
+	assert.ErrorIs(t, world.Connect(), ErrNoConnection)
+	_, _, err := world.GetWorld()
+	assert.ErrorIs(t, err, ErrNoConnection)
+	assert.ErrorIs(t, world.SendInput(&PlayerInput{}, 0), ErrNoConnection)
+}
+
+// Same as above, with channels instead of a transport.
+func TestPlayerProxyChan_WorldProxyChan(t *testing.T) {
+	var channel PlayerChannel
+	channel.Initialize()
+	player := PlayerProxyChan{&channel}
+	world := WorldProxyChan{&channel, time.Second, 1}
+
+	w := World{Players: make([]Player, 2)}
+	w.Players[0].Health = I(3)
+	var input PlayerInput
+	input.MoveLeft = true
+
+	// The player side.
+	go func() {
+		assert.Nil(t, world.Connect())
+		w2, frameIdx, err := world.GetWorld()
+		assert.Nil(t, err)
+		assert.Equal(t, 7, frameIdx)
+		assert.Equal(t, I(3), w2.Players[0].Health)
+
+		// The player has a copy, it can't change the world directly.
+		w2.Players[0].Health = I(4)
+
+		// An input for another frame is thrown away.
+		assert.Nil(t, world.SendInput(&PlayerInput{Shoot: true}, 6))
+		assert.Nil(t, world.SendInput(&input, frameIdx))
+	}()
+
+	// The world side.
+	assert.Equal(t, input, *player.SendWorldGetInput(&w, 7))
+	assert.Equal(t, I(3), w.Players[0].Health)
+
+	// Nobody sends a world anymore.
+	world.Timeout = time.Millisecond
+	_, _, err := world.GetWorld()
+	assert.ErrorIs(t, err, ErrTimeout)
+}
+
+func TestGuiProxyChan_PainterProxyChan(t *testing.T) {
+	var channel PaintChannel
+	channel.Initialize()
+	gui := GuiProxyChan{&channel}
+	painter := PainterProxyChan{&channel}
+
+	// The gui is slow, only the first paint data waits for it, the rest is
+	// dropped instead of blocking the painter.
+	var info DebugInfo
+	info.Points = append(info.Points, DebugPoint{Size: I(1)})
+	gui.SendPaintData(&info)
+	info.Points[0].Size = I(2)
+	gui.SendPaintData(&info)
+	assert.Equal(t, I(1), painter.GetPaintData().Points[0].Size)
+}
+
+// The world doesn't take a peer that isn't a player, but it keeps waiting
+// for one that is.
+func TestPlayerProxy_Handshake(t *testing.T) {
+	var transport MemoryTransport
+	player := PlayerProxyTcpIp{Endpoint: "player", Transport: &transport}
+
+	w := World{Players: make([]Player, 2)}
+	inputs := make(chan *PlayerInput)
+	go func() { inputs <- player.SendWorldGetInput(&w, 0) }()
+
+	painter := WorldProxyTcpIp{Endpoint: "player", Timeout: time.Second,
+		Transport: &transport, Role: RolePainter}
+	for {
+		err := painter.Connect()
+		if errors.Is(err, ErrHandshakeRejected) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	world := WorldProxyTcpIp{Endpoint: "player", Timeout: time.Second,
+		Transport: &transport}
+	for world.Connect() != nil {
+		time.Sleep(time.Millisecond)
+	}
+	_, frameIdx, err := world.GetWorld()
+	assert.Nil(t, err)
+	assert.Nil(t, world.SendInput(&PlayerInput{Shoot: true}, frameIdx))
+	assert.True(t, (<-inputs).Shoot)
+}
+
+func TestWorldServer(t *testing.T) {
+	var transport MemoryTransport
+	server := WorldServer{Endpoint: "world", Transport: &transport,
+		NPlayers: 2}
+	assert.Nil(t, server.Initialize())
+	defer server.Close()
+
+	connect := func(p *WorldProxyTcpIp) {
+		for p.Connect() != nil {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	newClient := func(role Role, slot int64) WorldProxyTcpIp {
+		return WorldProxyTcpIp{Endpoint: "world", Timeout: time.Second,
+			Transport: &transport, Role: role, Slot: slot}
+	}
+
+	// Players get the slots they ask for, or the first free one.
+	client2 := newClient(RolePlayer, 2)
+	connect(&client2)
+	assert.Equal(t, int64(2), client2.Slot)
+	client1 := newClient(RolePlayer, 0)
+	connect(&client1)
+	assert.Equal(t, int64(1), client1.Slot)
+	spectator := newClient(RoleSpectator, 0)
+	connect(&spectator)
+	spectator2 := newClient(RoleSpectator, 0)
+	connect(&spectator2)
+
+	// The server takes the spectators right after it answers them.
+	assert.Eventually(t, func() bool {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		return len(server.spectators) == 2
+	}, time.Second, time.Millisecond)
+
+	// No more room for players.
+	client3 := newClient(RolePlayer, 0)
+	assert.ErrorIs(t, client3.Connect(), ErrHandshakeRejected)
+	client3.Slot = 1
+	assert.ErrorIs(t, client3.Connect(), ErrHandshakeRejected)
+
+	// Play a frame.
+	w := World{Players: make([]Player, 2)}
+	w.Players[0].Health = I(3)
+	play := func(client *WorldProxyTcpIp, input PlayerInput) {
+		_, frameIdx, err := client.GetWorld()
+		assert.Nil(t, err)
+		assert.Nil(t, client.SendInput(&input, frameIdx))
+	}
+	go play(&client1, PlayerInput{MoveLeft: true})
+	go play(&client2, PlayerInput{MoveRight: true})
+	assert.True(t, server.Player(1).SendWorldGetInput(&w, 0).MoveLeft)
+	assert.True(t, server.Player(2).SendWorldGetInput(&w, 0).MoveRight)
+	server.SendWorldToSpectators(&w, 0)
+	w2, _, err := spectator.GetWorld()
+	assert.Nil(t, err)
+	assert.Equal(t, I(3), w2.Players[0].Health)
+	assert.ErrorIs(t, spectator.SendInput(&PlayerInput{}, 0), ErrSpectatorInput)
+	_, _, err = spectator2.GetWorld()
+	assert.Nil(t, err)
+
+	// Player 1 loses the connection and gets its slot back, once the world
+	// notices the connection is gone.
+	client1.conn.Close()
+	client1.conn = nil
+	inputs := make(chan *PlayerInput)
+	go func() { inputs <- server.Player(1).SendWorldGetInput(&w, 1) }()
+	connect(&client1)
+	assert.Equal(t, int64(1), client1.Slot)
+	play(&client1, PlayerInput{Shoot: true})
+	assert.True(t, (<-inputs).Shoot)
+
+	// A spectator that joins late gets the whole world, the others only get
+	// what changed.
+	spectator3 := newClient(RoleSpectator, 0)
+	connect(&spectator3)
+	assert.Eventually(t, func() bool {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		return len(server.spectators) == 3
+	}, time.Second, time.Millisecond)
+	w.Players[1].Health = I(5)
+	server.SendWorldToSpectators(&w, 1)
+	for _, s := range []*WorldProxyTcpIp{&spectator, &spectator2, &spectator3} {
+		w2, frameIdx, err := s.GetWorld()
+		assert.Nil(t, err)
+		assert.Equal(t, 1, frameIdx)
+		assert.Equal(t, w.Serialize(), w2.Serialize())
+	}
+}
+
+// A spectator that doesn't read the worlds doesn't hold up the world, and
+// the spectators that keep up still get every world.
+func TestWorldServer_SlowSpectator(t *testing.T) {
+	var transport MemoryTransport
+	server := WorldServer{Endpoint: "world", Transport: &transport,
+		NPlayers: 1}
+	assert.Nil(t, server.Initialize())
+	defer server.Close()
+	newSpectator := func() *WorldProxyTcpIp {
+		s := &WorldProxyTcpIp{Endpoint: "world", Timeout: time.Second,
+			Transport: &transport, Role: RoleSpectator}
+		for s.Connect() != nil {
+			time.Sleep(time.Millisecond)
+		}
+		return s
+	}
+	slow := newSpectator()
+	defer slow.conn.Close()
+	fast := newSpectator()
+	assert.Eventually(t, func() bool {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		return len(server.spectators) == 2
+	}, time.Second, time.Millisecond)
+
+	w := testLevel()
+	for i := 0; i < 100; i++ {
+		w.Players[0].Health = I(i)
+		start := time.Now()
+		server.SendWorldToSpectators(&w, i)
+		assert.Less(t, time.Since(start), spectatorWriteTimeout/2)
+		w2, frameIdx, err := fast.GetWorld()
+		assert.Nil(t, err)
+		assert.Equal(t, i, frameIdx)
+		assert.Equal(t, w.Serialize(), w2.Serialize())
+		// Give the slow spectator the time to fill its connection.
+		time.Sleep(time.Millisecond)
+	}
+
+	// The slow spectator is dropped.
+	assert.Eventually(t, func() bool {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		return len(server.spectators) == 1
+	}, time.Second, time.Millisecond)
+}
+
+// Whoever connects first gets the first slot. If the AI connects before the
+// GUI, the GUI plays the second player and must know it.
+func TestWorldServer_AIConnectsFirst(t *testing.T) {
+	var transport MemoryTransport
+	server := WorldServer{Endpoint: "world", Transport: &transport,
+		NPlayers: 2}
+	assert.Nil(t, server.Initialize())
+	defer server.Close()
+
+	ai := WorldProxyTcpIp{Endpoint: "world", Timeout: time.Second,
+		Transport: &transport}
+	gui := ai
+	assert.Equal(t, int64(0), gui.GetSlot())
+	for ai.Connect() != nil {
+		time.Sleep(time.Millisecond)
+	}
+	for gui.Connect() != nil {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, int64(1), ai.GetSlot())
+	assert.Equal(t, int64(2), gui.GetSlot())
+
+	// The GUI gets its own player from the world.
+	w := World{Players: make([]Player, 2)}
+	w.Players[1].Health = I(7)
+	go server.Player(2).SendWorldGetInput(&w, 0)
+	w2, _, err := gui.GetWorld()
+	assert.Nil(t, err)
+	assert.Equal(t, I(7), w2.Players[gui.GetSlot()-1].Health)
+}
+
+// A bot that talks JSON plays and watches like everyone else.
+func TestWorldServer_Json(t *testing.T) {
+	server := WorldServer{Endpoint: "world", Transport: &MemoryTransport{},
+		NPlayers: 1, JsonEndpoint: "localhost:0"}
+	assert.Nil(t, server.Initialize())
+	defer server.Close()
+
+	transport := TcpTransport{Codec: &LineCodec{}}
+	connect := func(handshake string) Conn {
+		conn, err := transport.Dial(server.JsonAddr(), time.Second)
+		assert.Nil(t, err)
+		assert.Nil(t, conn.WriteMessage([]byte(handshake), time.Second))
+		data, err := conn.ReadMessage(time.Second)
+		assert.Nil(t, err)
+		var reply HandshakeReply
+		assert.Nil(t, json.Unmarshal(data, &reply))
+		assert.True(t, reply.Accepted, reply.Reason)
+		return conn
+	}
+	getWorld := func(conn Conn) (jw JsonWorld) {
+		data, err := conn.ReadMessage(time.Second)
+		assert.Nil(t, err)
+		assert.Nil(t, json.Unmarshal(data, &jw))
+		return
+	}
+	player := connect(fmt.Sprintf(`{"ProtocolVersion":%d,"Role":"player"}`,
+		ProtocolVersion))
+	defer player.Close()
+	spectator := connect(fmt.Sprintf(`{"ProtocolVersion":%d,`+
+		`"Role":"spectator"}`, ProtocolVersion))
+	defer spectator.Close()
+	assert.Eventually(t, func() bool {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		return len(server.spectators) == 1
+	}, time.Second, time.Millisecond)
+
+	w := testLevel()
+	w.Obstacles.Set(I(1), I(2), I(1))
+	w.Players[1].Bounds.Center = Pt{I(70), I(80)}
+	inputs := make(chan *PlayerInput)
+	go func() { inputs <- server.Player(1).SendWorldGetInput(&w, 5) }()
+	jw := getWorld(player)
+	assert.Equal(t, int64(5), jw.Frame)
+	assert.Equal(t, int64(1), jw.You)
+	assert.Equal(t, 2, len(jw.Players))
+	assert.Equal(t, int64(3), jw.Players[0].Health)
+	assert.Equal(t, JsonPt{70, 80}, jw.Players[1].Pos)
+	assert.Equal(t, 5, len(jw.Balls))
+	assert.Equal(t, JsonPt{20, 20}, jw.Balls[2].Pos)
+	assert.Equal(t, w.Obstacles.NRows().ToInt64(), int64(len(jw.Obstacles)))
+	assert.Equal(t, int64(1), jw.Obstacles[1][2])
+	assert.Equal(t, int64(0), jw.Obstacles[2][1])
+	assert.True(t, jw.JustReloaded)
+
+	// Fields that are left out are false or 0, inputs for other frames are
+	// stale.
+	assert.Nil(t, player.WriteMessage([]byte(`{"Frame":4,"Shoot":true}`),
+		time.Second))
+	assert.Nil(t, player.WriteMessage([]byte(
+		`{"Frame":5,"MoveUp":true,"ShootPt":{"X":7,"Y":-3}}`), time.Second))
+	input := <-inputs
+	assert.Equal(t, PlayerInput{MoveUp: true, ShootPt: Pt{I(7), I(-3)}},
+		*input)
+
+	server.SendWorldToSpectators(&w, 5)
+	jw = getWorld(spectator)
+	assert.Equal(t, int64(0), jw.You)
+	assert.Equal(t, int64(5), jw.Frame)
+
+	// A typo is not ignored, the player is dropped.
+	go func() { inputs <- server.Player(1).SendWorldGetInput(&w, 6) }()
+	getWorld(player)
+	assert.Nil(t, player.WriteMessage([]byte(`{"Frame":6,"MoveLetf":true}`),
+		time.Second))
+	_, err := player.ReadMessage(time.Second)
+	assert.ErrorIs(t, err, ErrClosed)
+	player = connect(fmt.Sprintf(`{"ProtocolVersion":%d,"Role":"player"}`,
+		ProtocolVersion))
+	getWorld(player)
+	assert.Nil(t, player.WriteMessage([]byte(`{"Frame":6,"MoveLeft":true}`),
+		time.Second))
+	assert.True(t, (<-inputs).MoveLeft)
+}
+
+// A player that takes its time.
+type slowPlayer struct {
+	delay  time.Duration
+	inputs chan PlayerInput
+}
+
+func (p *slowPlayer) SendWorldGetInput(w *World, frameIdx int) *PlayerInput {
+	time.Sleep(p.delay)
+	input := <-p.inputs
+	return &input
+}
+
+type idleAI struct{}
+
+func (idleAI) Step(w *World, frameIdx int) PlayerInput {
+	return PlayerInput{Pause: true}
+}
+
+func TestTimedPlayer(t *testing.T) {
+	slow := slowPlayer{0, make(chan PlayerInput, 10)}
+	p := TimedPlayer{Player: &slow, Name: "test", Timeout: 50 * time.Millisecond,
+		Fallback: FallbackRepeat}
+	w := World{Players: make([]Player, 2)}
+
+	// In time.
+	slow.inputs <- PlayerInput{MoveLeft: true, Shoot: true, Pause: true}
+	assert.Equal(t, PlayerInput{MoveLeft: true, Shoot: true, Pause: true},
+		*p.SendWorldGetInput(&w, 0))
+
+	// Late, keep moving but don't shoot or pause again. The player is busy
+	// with frame 1 until it gets an input to answer with.
+	assert.Equal(t, PlayerInput{MoveLeft: true}, *p.SendWorldGetInput(&w, 1))
+	p.Fallback = FallbackIdle
+	assert.Equal(t, PlayerInput{}, *p.SendWorldGetInput(&w, 2))
+	p.Fallback = FallbackAI
+	p.AI = idleAI{}
+	assert.Equal(t, PlayerInput{Pause: true}, *p.SendWorldGetInput(&w, 3))
+
+	// The late answer is thrown away, the player gets a new world.
+	slow.inputs <- PlayerInput{MoveRight: true}
+	assert.Eventually(t, func() bool { return len(p.pending) == 1 },
+		time.Second, time.Millisecond)
+	slow.inputs <- PlayerInput{MoveUp: true}
+	assert.Equal(t, PlayerInput{MoveUp: true}, *p.SendWorldGetInput(&w, 4))
+
+	// Without a timeout, the world waits for the player.
+	p.Timeout = 0
+	slow.delay = 100 * time.Millisecond
+	slow.inputs <- PlayerInput{MoveDown: true}
+	assert.Equal(t, PlayerInput{MoveDown: true}, *p.SendWorldGetInput(&w, 5))
+}
+
+// The events of a frame get to the players, whether they play through a
+// TimedPlayer and the network or through a channel.
+func TestPlayers_GetEvents(t *testing.T) {
+	w := World{Players: make([]Player, 2)}
+	w.Events = []Event{{Type: EventPlayerHit, FrameIdx: 3, Player: 1,
+		BallType: I(1), Pos: IPt(10, 20)}}
+
+	var transport MemoryTransport
+	server := WorldServer{Endpoint: "world", Transport: &transport,
+		NPlayers: 1}
+	assert.Nil(t, server.Initialize())
+	defer server.Close()
+	client := WorldProxyTcpIp{Endpoint: "world", Timeout: time.Second,
+		Transport: &transport, Role: RolePlayer}
+	for client.Connect() != nil {
+		time.Sleep(time.Millisecond)
+	}
+	timed := TimedPlayer{Player: server.Player(1), Name: "test",
+		Timeout: time.Second, Fallback: FallbackIdle}
+	go func() {
+		w2, frameIdx, err := client.GetWorld()
+		assert.Nil(t, err)
+		assert.Equal(t, w.Events, w2.Events)
+		assert.Nil(t, client.SendInput(&PlayerInput{MoveLeft: true}, frameIdx))
+	}()
+	assert.True(t, timed.SendWorldGetInput(&w, 3).MoveLeft)
+
+	var channel PlayerChannel
+	channel.Initialize()
+	player := PlayerProxyChan{&channel}
+	world := WorldProxyChan{&channel, time.Second, 1}
+	go func() {
+		w2, frameIdx, err := world.GetWorld()
+		assert.Nil(t, err)
+		assert.Equal(t, w.Events, w2.Events)
+		assert.Nil(t, world.SendInput(&PlayerInput{MoveLeft: true}, frameIdx))
+	}()
+	assert.True(t, player.SendWorldGetInput(&w, 3).MoveLeft)
+}
+
+func TestValidatedPlayer(t *testing.T) {
+	player := slowPlayer{0, make(chan PlayerInput, 10)}
+	p := ValidatedPlayer{Player: &player, Name: "test", Slot: 2,
+		Rules: InputRules{MaxShotsPerSecond: 2, FrameRate: 10}}
+	w := testLevel()
+	w.Players[1].Bounds.Center = Pt{I(500), I(500)}
+	step := func(frameIdx int, input PlayerInput) PlayerInput {
+		player.inputs <- input
+		return *p.SendWorldGetInput(&w, frameIdx)
+	}
+	shoot := func(x, y int) PlayerInput {
+		return PlayerInput{Shoot: true, ShootPt: Pt{I(x), I(y)}}
+	}
+
+	// Only the host reloads and pauses, the rest of the input goes through.
+	assert.Equal(t, PlayerInput{MoveLeft: true},
+		step(0, PlayerInput{MoveLeft: true, Reload: true, Pause: true}))
+
+	// Shots must be in the level and not at the player.
+	assert.Equal(t, PlayerInput{}, step(1, shoot(1200, 10)))
+	assert.Equal(t, PlayerInput{}, step(2, shoot(-1, 10)))
+	assert.Equal(t, PlayerInput{}, step(3, shoot(500, 500)))
+	assert.Equal(t, shoot(1199, 999), step(4, shoot(1199, 999)))
+
+	// 2 shots per 10 frames.
+	assert.Equal(t, shoot(0, 0), step(5, shoot(0, 0)))
+	assert.Equal(t, PlayerInput{}, step(13, shoot(0, 0)))
+	assert.Equal(t, shoot(0, 0), step(14, shoot(0, 0)))
+
+	rejections := p.Rejections()
+	assert.Equal(t, 6, len(rejections))
+	assert.Equal(t, Rejection{0, PlayerInput{MoveLeft: true, Reload: true,
+		Pause: true}, "only the host may reload"}, rejections[0])
+	assert.Equal(t, Rejection{13, shoot(0, 0), "too many shots per second"},
+		rejections[5])
+	assert.Equal(t, map[string]int{
+		"only the host may reload":  1,
+		"only the host may pause":   1,
+		"shot outside the level":    2,
+		"shot at itself":            1,
+		"too many shots per second": 1}, p.NRejected())
+
+	// The host may.
+	p.Rules.Host = true
+	assert.Equal(t, PlayerInput{Reload: true, Pause: true},
+		step(15, PlayerInput{Reload: true, Pause: true}))
+	assert.Equal(t, 6, len(p.Rejections()))
+
+	// Without a limit, every shot goes through and none is remembered.
+	p.Rules.MaxShotsPerSecond = 0
+	p.shots = nil
+	for i := 16; i < 100; i++ {
+		assert.Equal(t, shoot(0, 0), step(i, shoot(0, 0)))
+	}
+	assert.Empty(t, p.shots)
+}
+
+func TestSendWorldGetInputs(t *testing.T) {
+	// Player 2 answers first, but its input is still second.
+	player1 := slowPlayer{100 * time.Millisecond, make(chan PlayerInput, 1)}
+	player2 := slowPlayer{0, make(chan PlayerInput, 1)}
+	player3 := slowPlayer{100 * time.Millisecond, make(chan PlayerInput, 1)}
+	player1.inputs <- PlayerInput{MoveLeft: true}
+	player2.inputs <- PlayerInput{MoveRight: true}
+	player3.inputs <- PlayerInput{MoveUp: true}
+
+	w := World{Players: make([]Player, 2)}
+	start := time.Now()
+	inputs := SendWorldGetInputs(&w, 0, &player1, &player2, &player3)
+	assert.Less(t, time.Since(start), 190*time.Millisecond)
+	assert.Equal(t, []PlayerInput{{MoveLeft: true}, {MoveRight: true},
+		{MoveUp: true}}, inputs)
+}
+
+func testLevel() (w World) {
+	w.Obstacles.Init(I(10), I(12))
+	w.Obstacles.Set(I(2), I(3), I(1))
+	w.ObstacleSize = I(100)
+	w.BallSpeed = I(40)
+	w.BallDec = I(1)
+	w.BallDiameter = I(30)
+	w.Players = make([]Player, 2)
+	w.Players[0].Health = I(3)
+	w.Players[1].Health = I(3)
+	for i := 0; i < 5; i++ {
+		var b Ball
+		b.Bounds.Center = Pt{I(i * 10), I(20)}
+		w.Balls = append(w.Balls, b)
+	}
+	w.JustReloaded = ONE
+	return
+}
+
+// The decoder rebuilds every world the encoder got, from a whole world
+// followed by changes.
+func TestWorldEncoder_WorldDecoder(t *testing.T) {
+	var encoder worldEncoder
+	var decoder worldDecoder
+	w := testLevel()
+	frameIdx := 0
+	step := func() []byte {
+		data := encoder.Encode(&w, frameIdx)
+		w2, frameIdx2, err := decoder.Decode(data)
+		assert.Nil(t, err)
+		assert.Equal(t, frameIdx, frameIdx2)
+		assert.Equal(t, w.Serialize(), w2.Serialize())
+		assert.Equal(t, w.Events, w2.Events)
+
+		// What the caller does with its world doesn't matter to the
+		// decoder.
+		w2.Players[0].Health = I(100)
+		w2.Balls = nil
+		frameIdx++
+		return data
+	}
+	snapshot := step()
+
+	// One ball moves.
+	w.JustReloaded = ZERO
+	w.Balls[2].Bounds.Center.X = I(7)
+	delta := step()
+	assert.Less(t, len(delta)*10, len(snapshot))
+
+	// Nothing changes.
+	step()
+
+	// Something happens, then nothing happens anymore.
+	w.Events = []Event{{EventPlayerHit, 3, 1, I(2), Pt{I(5), I(6)}}}
+	step()
+	w.Events = nil
+	step()
+
+	// Players change, balls come and go.
+	w.Players[0].Bounds.Center = Pt{I(3), I(4)}
+	w.Balls = append(w.Balls, Ball{Speed: I(5)})
+	step()
+	w.Players[1].State = PlayerStunned
+	w.Players = append(w.Players, Player{Team: I(2)})
+	w.Balls = w.Balls[:2]
+	w.DebugInfo.Points = append(w.DebugInfo.Points, DebugPoint{})
+	step()
+	w.Balls = nil
+	w.Players = w.Players[:1]
+	w.DebugInfo.Points = nil
+	step()
+	w.Over = ONE
+	step()
+
+	// The level is reloaded.
+	w = testLevel()
+	w.Obstacles.Set(I(5), I(5), I(1))
+	w.ObstacleSize = I(90)
+	step()
+
+	// The level is reloaded in a frame that isn't sent, like when the
+	// player is late. The next world that is sent still has the new level.
+	w.Obstacles.Set(I(6), I(6), I(1))
+	frameIdx++
+	w.JustReloaded = ZERO
+	step()
+}
+
+// Whatever a peer sends, a message we can't read is an error, not a crash.
+func TestMalformedMessages(t *testing.T) {
+	_, _, err := deserializeInputMessage([]byte{1, 2, 3})
+	assert.ErrorIs(t, err, ErrMalformedMessage)
+
+	var encoder worldEncoder
+	w := testLevel()
+	snapshot := encoder.Encode(&w, 0)
+	w.Balls[0].Speed = I(1)
+	delta := encoder.Encode(&w, 1)
+	huge := new(bytes.Buffer)
+	Serialize(huge, int64(0))
+	Serialize(huge, byte(0)) // A whole world.
+	Serialize(huge, int64(1<<40))
+	for _, data := range [][]byte{nil, snapshot[:len(snapshot)/2],
+		huge.Bytes()} {
+		var decoder worldDecoder
+		_, _, err = decoder.Decode(data)
+		assert.ErrorIs(t, err, ErrMalformedMessage)
+	}
+	var decoder worldDecoder
+	_, _, err = decoder.Decode(snapshot)
+	assert.Nil(t, err)
+	_, _, err = decoder.Decode(delta[:len(delta)-1])
+	assert.ErrorIs(t, err, ErrMalformedMessage)
+
+	// A delta that changes a ball the world doesn't have.
+	badDelta := func(ballIdx int64) []byte {
+		buf := new(bytes.Buffer)
+		Serialize(buf, int64(1))
+		Serialize(buf, worldDelta)
+		Serialize(buf, int64(0))
+		Serialize(buf, uint8(0))
+		Serialize(buf, int64(len(w.Players)))
+		SerializeSlice(buf, []changedPlayer{})
+		Serialize(buf, int64(len(w.Balls)))
+		SerializeSlice(buf, []changedBall{{Index: ballIdx}})
+		Serialize(buf, w.Over)
+		Serialize(buf, w.JustReloaded)
+		SerializeSlice(buf, []Event{})
+		return buf.Bytes()
+	}
+	for _, ballIdx := range []int64{-1, int64(len(w.Balls))} {
+		decoder = worldDecoder{}
+		_, _, err = decoder.Decode(snapshot)
+		assert.Nil(t, err)
+		_, _, err = decoder.Decode(badDelta(ballIdx))
+		assert.ErrorIs(t, err, ErrMalformedMessage)
+	}
+	_, _, err = decoder.Decode(badDelta(0))
+	assert.Nil(t, err)
+
+	// The lockstep peer stops, like when the connection is lost.
+	host, guest := connectLockstep(t, LockstepSetup{})
+	host.Timeout = time.Second
+	assert.Nil(t, guest.conn.WriteMessage([]byte{1, 2, 3}, time.Second))
+	_, _, err = host.Step(PlayerInput{}, 0, 1)
+	assert.ErrorIs(t, err, ErrMalformedMessage)
+}
+
+func TestWorldDecoder_OutOfSync(t *testing.T) {
+	var encoder worldEncoder
+	w := testLevel()
+	first := encoder.Encode(&w, 0)
+	w.Balls[0].Speed = I(1)
+	encoder.Encode(&w, 1)
+	w.Balls[0].Speed = I(2)
+	third := encoder.Encode(&w, 2)
+
+	// A decoder that missed a world can't use the changes.
+	var decoder worldDecoder
+	_, _, err := decoder.Decode(first)
+	assert.Nil(t, err)
+	_, _, err = decoder.Decode(third)
+	assert.ErrorIs(t, err, ErrOutOfSync)
+
+	// Neither can a decoder that has no world yet.
+	decoder.Reset()
+	_, _, err = decoder.Decode(third)
+	assert.ErrorIs(t, err, ErrOutOfSync)
+
+	// A world proxy that is out of sync drops the connection, so that it
+	// gets the whole world on the next one.
+	var transport MemoryTransport
+	player := PlayerProxyTcpIp{Endpoint: "player", Transport: &transport}
+	world := WorldProxyTcpIp{Endpoint: "player", Timeout: time.Second,
+		Transport: &transport}
+	go func() {
+		for world.Connect() != nil {
+			time.Sleep(time.Millisecond)
+		}
+		_, _, err := world.GetWorld()
+		assert.Nil(t, err)
+		world.decoder.lastFrameIdx = 100
+		assert.Nil(t, world.SendInput(&PlayerInput{}, 0))
+		_, _, err = world.GetWorld()
+		assert.ErrorIs(t, err, ErrOutOfSync)
+		assert.Nil(t, world.conn)
+
+		for world.Connect() != nil {
+			time.Sleep(time.Millisecond)
+		}
+		w2, frameIdx, err := world.GetWorld()
+		assert.Nil(t, err)
+		assert.Equal(t, 2, frameIdx)
+		assert.Equal(t, w.Serialize(), w2.Serialize())
+		assert.Nil(t, world.SendInput(&PlayerInput{Shoot: true}, frameIdx))
+	}()
+	player.SendWorldGetInput(&w, 0)
+	w.Balls[0].Speed = I(3)
+	assert.True(t, player.SendWorldGetInput(&w, 2).Shoot)
+}
+
+// Connect two players in lockstep mode. The host decides the setup.
+func connectLockstep(t *testing.T, setup LockstepSetup) (host *LockstepPeer,
+	guest *LockstepPeer) {
+	var transport MemoryTransport
+	host = &LockstepPeer{Endpoint: "lockstep", Transport: &transport,
+		Host: true}
+	guest = &LockstepPeer{Endpoint: "lockstep", Transport: &transport}
+
+	hostSetup := make(chan LockstepSetup)
+	go func() {
+		s, err := host.Connect(setup)
+		assert.Nil(t, err)
+		hostSetup <- s
+	}()
+	var guestSetup LockstepSetup
+	for {
+		var err error
+		guestSetup, err = guest.Connect(LockstepSetup{InputDelay: 10})
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, setup, <-hostSetup)
+	assert.Equal(t, setup, guestSetup)
+	return
+}
+
+// Each player runs its own world and only the inputs go over the network,
+// yet both play the same game.
+func TestLockstepPeer(t *testing.T) {
+	const nFrames = 200
+	setup := LockstepSetup{42, testWorldConfig(), 3, 0}
+	host, guest := connectLockstep(t, setup)
+	assert.Equal(t, 0, host.PlayerIdx())
+	assert.Equal(t, 1, guest.PlayerIdx())
+
+	play := func(peer *LockstepPeer, wr *WorldRunner,
+		input func(frameIdx int) PlayerInput, checksums chan []uint64) {
+		var inputs []Input
+		for wr.GetFrameIdx() < nFrames {
+			frameIdx := wr.GetFrameIdx()
+			in, ok, err := peer.Step(input(frameIdx), frameIdx,
+				wr.GetWorld().Checksum())
+			assert.Nil(t, err)
+			if ok {
+				inputs = append(inputs, in)
+				wr.Step(in)
+			}
+		}
+
+		// The inputs are delayed.
+		for i := 0; i < int(setup.InputDelay); i++ {
+			assert.Equal(t, Input{Players: make([]PlayerInput, 2)}, inputs[i])
+		}
+		assert.Equal(t, Input{Players: []PlayerInput{input1(0), input2(0)}},
+			inputs[setup.InputDelay])
+		checksums <- wr.GetChecksums()
+	}
+	// The random generator is shared, so initialize the worlds one at a
+	// time.
+	var wr1, wr2 WorldRunner
+	wr1.InitializeLockstep("", setup.Seed, setup.Config)
+	wr2.InitializeLockstep("", setup.Seed, setup.Config)
+	checksums1 := make(chan []uint64)
+	checksums2 := make(chan []uint64)
+	go play(host, &wr1, input1, checksums1)
+	go play(guest, &wr2, input2, checksums2)
+	sums := <-checksums1
+	assert.Equal(t, sums, <-checksums2)
+	assert.NotEqual(t, sums[0], sums[nFrames-1])
+}
+
+func input1(frameIdx int) (input PlayerInput) {
+	input.MoveRight = frameIdx < 50
+	input.Shoot = frameIdx == 60
+	input.ShootPt = Pt{I(30000), I(10000)}
+	return
+}
+
+func input2(frameIdx int) (input PlayerInput) {
+	input.MoveDown = frameIdx >= 20
+	input.Shoot = frameIdx == 30
+	input.ShootPt = Pt{I(10000), I(10000)}
+	return
+}
+
+func TestLockstepPeer_WaitAndDesync(t *testing.T) {
+	host, guest := connectLockstep(t, LockstepSetup{InputDelay: 0})
+	host.Timeout = 10 * time.Millisecond
+	guest.Timeout = 10 * time.Millisecond
+
+	// The other player is late, the frame can't be stepped yet. Our input
+	// is only given once.
+	_, ok, err := host.Step(PlayerInput{MoveUp: true}, 0, 1)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	_, ok, err = host.Step(PlayerInput{MoveDown: true}, 0, 1)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	expected := Input{Players: []PlayerInput{PlayerInput{MoveUp: true}, PlayerInput{MoveLeft: true}}}
+	inputs, ok, err := guest.Step(PlayerInput{MoveLeft: true}, 0, 1)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, expected, inputs)
+	inputs, ok, err = host.Step(PlayerInput{}, 0, 1)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, expected, inputs)
+
+	// The worlds are not the same anymore.
+	_, ok, err = guest.Step(PlayerInput{}, 1, 2)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	_, _, err = host.Step(PlayerInput{}, 1, 3)
+	assert.ErrorIs(t, err, ErrDesync)
+	_, _, err = guest.Step(PlayerInput{}, 1, 2)
+	assert.ErrorIs(t, err, ErrDesync)
+}
+
+func TestLockstepPeer_Rollback(t *testing.T) {
+	host, guest := connectLockstep(t, LockstepSetup{Rollback: 10})
+
+	// Inputs go through without waiting for anything.
+	assert.Nil(t, host.SendInput(PlayerInput{MoveUp: true}, 0, 0, 1))
+	assert.Nil(t, host.SendInput(PlayerInput{MoveDown: true}, 1, -1, 0))
+	var inputs []FrameInput
+	assert.Eventually(t, func() bool {
+		received, err := guest.ReceiveInputs()
+		assert.Nil(t, err)
+		inputs = append(inputs, received...)
+		return len(inputs) == 2
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, []FrameInput{{0, PlayerInput{MoveUp: true}},
+		{1, PlayerInput{MoveDown: true}}}, inputs)
+
+	// The worlds are not the same anymore.
+	assert.Nil(t, guest.SendInput(PlayerInput{}, 0, 0, 2))
+	assert.Eventually(t, func() bool {
+		_, err := host.ReceiveInputs()
+		return errors.Is(err, ErrDesync)
+	}, time.Second, time.Millisecond)
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	. "playful-patterns.com/bakoko/world"
+	"time"
+)
+
+// FallbackPolicy says what a player does in a frame for which its input
+// didn't arrive in time.
+type FallbackPolicy string
+
+const (
+	// Keep doing what the player did last, but don't repeat actions that
+	// happen once per key press (shooting, reloading, quitting) or that
+	// would keep the game paused for everyone.
+	FallbackRepeat FallbackPolicy = "repeat"
+	// Do nothing.
+	FallbackIdle FallbackPolicy = "idle"
+	// Let an AI play instead of the player until the player is back.
+	FallbackAI FallbackPolicy = "ai"
+)
+
+func ParseFallbackPolicy(s string) (FallbackPolicy, error) {
+	switch p := FallbackPolicy(s); p {
+	case FallbackRepeat, FallbackIdle, FallbackAI:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown fallback policy %q, expected %s, %s "+
+			"or %s", s, FallbackRepeat, FallbackIdle, FallbackAI)
+	}
+}
+
+// Stepper is something that can play, like an AI.
+type Stepper interface {
+	Step(w *World, frameIdx int) PlayerInput
+}
+
+// TimedPlayer is a PlayerProxy that doesn't let a slow or disconnected
+// player hold up the world. If the player doesn't answer before the timeout,
+// the world gets an input from the fallback policy instead. A timeout of 0
+// means the world waits for the player as long as it takes, like
+// ReadMessage(0) does.
+// The world is only sent again once the player answered. If the answer
+// comes late, it is thrown away, as it reacts to a world that is gone.
+type TimedPlayer struct {
+	Player   PlayerProxy
+	Name     string // For the logs.
+	Timeout  time.Duration
+	Fallback FallbackPolicy
+	AI       Stepper // Only needed for FallbackAI.
+
+	// The answer to the world we sent, if we are still waiting for it.
+	pending    chan frameInput
+	lastInput  PlayerInput
+	lateFrames int
+}
+
+func (p *TimedPlayer) SendWorldGetInput(w *World, frameIdx int) *PlayerInput {
+	// Send the world, unless the player is still busy with the previous one.
+	if p.pending != nil {
+		select {
+		case <-p.pending:
+			// A late answer, throw it away.
+			p.pending = nil
+		default:
+		}
+	}
+	if p.pending == nil {
+		p.pending = make(chan frameInput, 1)
+		go func(pending chan frameInput, w *World) {
+			input := p.Player.SendWorldGetInput(w, frameIdx)
+			pending <- frameInput{*input, frameIdx}
+		}(p.pending, copyWorld(w))
+	}
+
+	select {
+	case answer := <-p.pending:
+		p.pending = nil
+		// The answer may come while we wait, but be for an older frame.
+		if answer.frameIdx == frameIdx {
+			if p.lateFrames > 0 {
+				log.Printf("%s is back after %d late frames", p.Name,
+					p.lateFrames)
+				p.lateFrames = 0
+			}
+			p.lastInput = answer.input
+			return &answer.input
+		}
+	case <-TimeoutChan(p.Timeout):
+	}
+
+	if p.lateFrames == 0 {
+		log.Printf("%s is late, falling back to %s", p.Name, p.Fallback)
+	}
+	p.lateFrames++
+	input := p.fallbackInput(w, frameIdx)
+	return &input
+}
+
+func (p *TimedPlayer) fallbackInput(w *World, frameIdx int) (input PlayerInput) {
+	switch p.Fallback {
+	case FallbackRepeat:
+		input = p.lastInput
+		input.Shoot = false
+		input.Reload = false
+		input.Quit = false
+		input.Pause = false
+	case FallbackAI:
+		input = p.AI.Step(w, frameIdx)
+	case FallbackIdle:
+	default:
+		Check(fmt.Errorf("unknown fallback policy %q", p.Fallback))
+	}
+	return
+}
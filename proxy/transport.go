@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"log"
+	. "playful-patterns.com/bakoko/world"
+	"time"
+)
+
+// The proxies use TCP/IP unless they are given another transport.
+func getTransport(t Transport) Transport {
+	if t == nil {
+		return &TcpTransport{}
+	}
+	return t
+}
+
+// How long to wait before trying to listen again, if listening failed.
+// Most likely the port is still held by a previous run that is closing.
+const listenRetryInterval = time.Second
+
+// Wait for one peer with the given role to connect at the endpoint. Keep
+// trying if we can't listen, the servers have nothing to do until they get a
+// peer anyway.
+func acceptOne(t Transport, endpoint string, role Role) Conn {
+	for {
+		conn, err := listenAndAcceptOne(t, endpoint, role)
+		if err == nil {
+			return conn
+		}
+		log.Println(err)
+		time.Sleep(listenRetryInterval)
+	}
+}
+
+func listenAndAcceptOne(t Transport, endpoint string, role Role) (Conn, error) {
+	// Listen for incoming connections
+	listener, err := t.Listen(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+
+	for {
+		// Accept one incoming connection.
+		conn, err := listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		// Only keep the peer if it speaks our protocol. Otherwise, wait
+		// for another one.
+		if err = ServerHandshake(conn, role); err != nil {
+			log.Printf("rejected peer at %s: %v", endpoint, err)
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
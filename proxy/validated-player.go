@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"log"
+	. "playful-patterns.com/bakoko/world"
+	"sync"
+)
+
+// The world does whatever the inputs say. That's fine when the players are
+// our own gui and AI, but a remote player can be anything, and a buggy or
+// hostile bot can:
+// - reload the level or pause the game whenever it wants, which resets or
+// freezes the match for everyone
+// - shoot every frame
+// - shoot at points far outside the level (which can overflow the math of
+// the ball) or at its own position (which has no direction)
+// ValidatedPlayer stands between the world and such a player and takes out
+// of its inputs whatever the rules don't allow. The rest of the input, like
+// the movement, still goes through.
+
+// InputRules say what a player may do.
+type InputRules struct {
+	// Reloading the level and pausing the game affect everyone, only the
+	// host may do them.
+	Host bool
+	// How many shots the player may fire in FrameRate frames (a second of
+	// the game). 0 means no limit.
+	MaxShotsPerSecond int
+	FrameRate         int
+}
+
+// Rejection is an input, or a part of an input, that broke a rule.
+type Rejection struct {
+	FrameIdx int
+	Input    PlayerInput // The input as the player sent it.
+	Reason   string
+}
+
+// How many rejections a ValidatedPlayer remembers. A player that keeps
+// breaking the rules only has its latest rejections remembered.
+const maxRejections = 1000
+
+// ValidatedPlayer is a PlayerProxy that enforces the rules on the inputs of
+// another PlayerProxy.
+type ValidatedPlayer struct {
+	Player PlayerProxy
+	Name   string // For the logs.
+	Slot   int    // Players[Slot-1] is the player in the world.
+	Rules  InputRules
+
+	// The frames of the shots that went through in the last second, if
+	// there is a limit.
+	shots []int
+
+	mutex      sync.Mutex
+	rejections []Rejection
+	nRejected  map[string]int
+}
+
+func (p *ValidatedPlayer) SendWorldGetInput(w *World, frameIdx int) *PlayerInput {
+	input := *p.Player.SendWorldGetInput(w, frameIdx)
+	valid := input
+
+	reject := func(reason string) {
+		p.reject(Rejection{frameIdx, input, reason})
+	}
+	if !p.Rules.Host {
+		if input.Reload {
+			valid.Reload = false
+			reject("only the host may reload")
+		}
+		if input.Pause {
+			valid.Pause = false
+			reject("only the host may pause")
+		}
+	}
+	if input.Shoot {
+		if reason := p.checkShot(w, frameIdx, input.ShootPt); reason != "" {
+			valid.Shoot = false
+			valid.ShootPt = Pt{}
+			reject(reason)
+		} else if p.Rules.MaxShotsPerSecond > 0 {
+			p.shots = append(p.shots, frameIdx)
+		}
+	}
+	return &valid
+}
+
+// Returns why the shot is not allowed, or "" if it is.
+func (p *ValidatedPlayer) checkShot(w *World, frameIdx int, pt Pt) string {
+	width := w.Obstacles.NCols().Times(w.ObstacleSize)
+	height := w.Obstacles.NRows().Times(w.ObstacleSize)
+	if pt.X.IsNegative() || pt.Y.IsNegative() || pt.X.Geq(width) ||
+		pt.Y.Geq(height) {
+		return "shot outside the level"
+	}
+
+	if p.Slot >= 1 && p.Slot <= len(w.Players) &&
+		pt == w.Players[p.Slot-1].Bounds.Center {
+		return "shot at itself"
+	}
+
+	if p.Rules.MaxShotsPerSecond > 0 {
+		// Forget the shots that are more than a second old.
+		for len(p.shots) > 0 && p.shots[0] <= frameIdx-p.Rules.FrameRate {
+			p.shots = p.shots[1:]
+		}
+		if len(p.shots) >= p.Rules.MaxShotsPerSecond {
+			return "too many shots per second"
+		}
+	}
+	return ""
+}
+
+func (p *ValidatedPlayer) reject(r Rejection) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.nRejected == nil {
+		p.nRejected = map[string]int{}
+	}
+	// A player that breaks a rule usually keeps breaking it, say it once.
+	if p.nRejected[r.Reason] == 0 {
+		log.Printf("%s broke a rule in frame %d: %s", p.Name, r.FrameIdx,
+			r.Reason)
+	}
+	p.nRejected[r.Reason]++
+	p.rejections = append(p.rejections, r)
+	if len(p.rejections) > maxRejections {
+		p.rejections = p.rejections[1:]
+	}
+}
+
+// Rejections returns the latest inputs that broke the rules, oldest first.
+func (p *ValidatedPlayer) Rejections() []Rejection {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]Rejection(nil), p.rejections...)
+}
+
+// NRejected returns how many inputs broke each rule so far.
+func (p *ValidatedPlayer) NRejected() map[string]int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	n := map[string]int{}
+	for reason, count := range p.nRejected {
+		n[reason] = count
+	}
+	return n
+}
@@ -1,10 +1,8 @@
 package proxy
 
 import (
-	"bytes"
 	"errors"
 	"log"
-	"net"
 	. "playful-patterns.com/bakoko/world"
 	"time"
 )
@@ -19,15 +17,28 @@ import (
 // This is a client that connects to a server.
 type WorldProxy interface {
 	Connect() error
-	SendInput(input *PlayerInput) error
-	GetWorld() (w *World, err error)
+	// The input is the reaction to the world of this frame.
+	SendInput(input *PlayerInput, frameIdx int) error
+	GetWorld() (w *World, frameIdx int, err error)
+	// The slot of the player we play, Players[slot-1] in the world. It is 0
+	// until the world gave us a slot, and for spectators.
+	GetSlot() int64
 }
 
+var ErrSpectatorInput = errors.New("spectators don't send inputs")
+
 // TCP IP
 type WorldProxyTcpIp struct {
-	Endpoint string
-	Timeout  time.Duration
-	conn     net.Conn
+	Endpoint  string
+	Timeout   time.Duration
+	Transport Transport // nil means TCP/IP.
+	Role      Role      // "" means RolePlayer.
+	// The slot to ask the world for, 0 means any free slot. After
+	// connecting, it is the slot we got, so that we get it back if we lose
+	// the connection.
+	Slot    int64
+	conn    Conn
+	decoder worldDecoder
 }
 
 func (p *WorldProxyTcpIp) Connect() error {
@@ -37,55 +48,128 @@ func (p *WorldProxyTcpIp) Connect() error {
 	}
 
 	// We don't have a peer, connect to one.
-	conn, err := net.DialTimeout("tcp", p.Endpoint, p.Timeout)
+	conn, err := getTransport(p.Transport).Dial(p.Endpoint, p.Timeout)
 	if err != nil {
 		return err // Error, give up.
 	}
 
+	// Tell the world who we are, it will refuse us if we don't speak the
+	// same protocol.
+	role := p.Role
+	if role == "" {
+		role = RolePlayer
+	}
+	slot, err := ClientHandshake(conn, role, p.Slot, p.Timeout)
+	if err != nil {
+		log.Println(err)
+		conn.Close()
+		return err
+	}
+	p.Slot = slot
+
 	p.conn = conn
+	// The world starts over with a whole world on a new connection.
+	p.decoder.Reset()
 	return nil
 }
 
 // Try to send an input to the peer, but don't block.
-func (p *WorldProxyTcpIp) SendInput(input *PlayerInput) error {
+func (p *WorldProxyTcpIp) SendInput(input *PlayerInput, frameIdx int) error {
+	// The world doesn't read anything from spectators.
+	if p.Role == RoleSpectator {
+		return &TransportError{Op: "write", Endpoint: p.Endpoint,
+			Err: ErrSpectatorInput}
+	}
 	if p.conn == nil {
-		return errors.New("no connection")
+		return &TransportError{Op: "write", Endpoint: p.Endpoint,
+			Err: ErrNoConnection}
 	}
 
 	// Try to send our input.
-	buf := new(bytes.Buffer)
-	Serialize(buf, input)
-
-	err := WriteData(p.conn, buf.Bytes(), p.Timeout)
+	data := serializeInputMessage(input, frameIdx)
+	err := p.conn.WriteMessage(data, p.Timeout)
 	// If there was an error, assume the peer is no longer available.
 	// Invalidate the connection and move on.
 	if err != nil {
-		log.Println(err)
 		p.conn.Close()
 		p.conn = nil
-		log.Println("lost connection (1)")
+		log.Println("lost connection (1):", err)
 		return err
 	}
 	return nil
 }
 
 // Try to get the world, but don't block if it doesn't work.
-func (p *WorldProxyTcpIp) GetWorld() (w *World, err error) {
+func (p *WorldProxyTcpIp) GetWorld() (w *World, frameIdx int, err error) {
 	if p.conn == nil {
-		return nil, errors.New("no connection")
+		return nil, 0, &TransportError{Op: "read", Endpoint: p.Endpoint,
+			Err: ErrNoConnection}
 	}
 
-	data, err := ReadData(p.conn, p.Timeout)
+	data, err := p.conn.ReadMessage(p.Timeout)
 	// If there was an error, assume the peer is no longer available.
 	// Invalidate the connection and try again later.
 	if err != nil {
 		p.conn.Close()
 		p.conn = nil
-		log.Println("lost connection (3)")
-		return nil, err
+		log.Println("lost connection (3):", err)
+		return nil, 0, err
+	}
+
+	w, frameIdx, err = p.decoder.Decode(data)
+	// If we can't follow the world anymore, reconnect to get it whole.
+	if err != nil {
+		p.conn.Close()
+		p.conn = nil
+		log.Println("lost connection (4):", err)
+		return nil, 0, &TransportError{Op: "read", Endpoint: p.Endpoint,
+			Err: err}
+	}
+	return w, frameIdx, nil
+}
+
+func (p *WorldProxyTcpIp) GetSlot() int64 {
+	if p.conn == nil || p.Role == RoleSpectator {
+		return 0
+	}
+	return p.Slot
+}
+
+// This is the same as WorldProxyTcpIp, except it talks to a PlayerProxyChan
+// through a PlayerChannel.
+type WorldProxyChan struct {
+	Channel *PlayerChannel
+	Timeout time.Duration
+	// The channel belongs to a slot from the start.
+	Slot int64
+}
+
+// There is nothing to connect to, the channel is there from the start.
+func (p *WorldProxyChan) Connect() error {
+	if p.Channel == nil {
+		return &TransportError{Op: "dial", Err: ErrNoConnection}
+	}
+	return nil
+}
+
+func (p *WorldProxyChan) SendInput(input *PlayerInput, frameIdx int) error {
+	select {
+	case p.Channel.inputs <- frameInput{*input, frameIdx}:
+		return nil
+	case <-TimeoutChan(p.Timeout):
+		return &TransportError{Op: "write", Err: ErrTimeout}
 	}
+}
+
+func (p *WorldProxyChan) GetWorld() (w *World, frameIdx int, err error) {
+	select {
+	case fw := <-p.Channel.worlds:
+		return fw.w, fw.frameIdx, nil
+	case <-TimeoutChan(p.Timeout):
+		return nil, 0, &TransportError{Op: "read", Err: ErrTimeout}
+	}
+}
 
-	w = &World{}
-	w.Deserialize(bytes.NewBuffer(data))
-	return w, nil
+func (p *WorldProxyChan) GetSlot() int64 {
+	return p.Slot
 }
@@ -0,0 +1,323 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	. "playful-patterns.com/bakoko/world"
+	"slices"
+	"sync"
+	"time"
+)
+
+// WorldServer is what the world uses to talk to everyone in SplitRecording
+// mode, on a single endpoint. Whoever connects says in the handshake if it
+// wants to play or just to watch:
+// - players get one of the player slots and the world talks to each of them
+// through a PlayerProxy
+// - spectators get the world, but the world doesn't wait for anything from
+// them
+// If a player loses the connection, its slot waits for a player to take it
+// again. A client that reconnects asks for the slot it had, so it continues
+// the same game as the same player.
+// Bots that talk JSON (see json.go) connect to a second endpoint, if there is
+// one. Other than that, they are players and spectators like the others.
+type WorldServer struct {
+	Endpoint  string
+	Transport Transport // nil means TCP/IP.
+	NPlayers  int
+	// "" means no JSON endpoint.
+	JsonEndpoint  string
+	JsonTransport Transport // nil means TCP/IP, one message per line.
+
+	mutex      sync.Mutex
+	slotFilled *sync.Cond
+	listener   Listener
+	// nil if there is no JSON endpoint.
+	jsonListener Listener
+	players      []Conn // nil means the slot has no player (yet).
+	// A slot is taken from the moment it is promised in a handshake, which
+	// is before its player is ready.
+	taken         []bool
+	spectators    []*spectator
+	playerProxies []*worldServerPlayer
+}
+
+// Initialize starts listening at the endpoint and accepting clients in the
+// background.
+func (s *WorldServer) Initialize() error {
+	s.slotFilled = sync.NewCond(&s.mutex)
+	s.players = make([]Conn, s.NPlayers)
+	s.taken = make([]bool, s.NPlayers)
+	s.spectators = nil
+	s.playerProxies = make([]*worldServerPlayer, s.NPlayers)
+	for i := range s.playerProxies {
+		s.playerProxies[i] = &worldServerPlayer{server: s, slot: i + 1}
+	}
+
+	var err error
+	s.listener, err = getTransport(s.Transport).Listen(s.Endpoint)
+	if err != nil {
+		return err
+	}
+	s.jsonListener = nil
+	if s.JsonEndpoint != "" {
+		transport := s.JsonTransport
+		if transport == nil {
+			transport = &TcpTransport{Codec: &LineCodec{}}
+		}
+		s.jsonListener, err = transport.Listen(s.JsonEndpoint)
+		if err != nil {
+			s.listener.Close()
+			return err
+		}
+		go s.acceptClients(s.jsonListener, true)
+	}
+	go s.acceptClients(s.listener, false)
+	return nil
+}
+
+func (s *WorldServer) Close() {
+	s.listener.Close()
+	if s.jsonListener != nil {
+		s.jsonListener.Close()
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, sp := range s.spectators {
+		close(sp.worlds)
+	}
+	s.spectators = nil
+}
+
+// Addr is the endpoint the server actually listens at.
+func (s *WorldServer) Addr() string {
+	return s.listener.Addr()
+}
+
+// JsonAddr is the endpoint the server actually listens at for bots that
+// talk JSON.
+func (s *WorldServer) JsonAddr() string {
+	return s.jsonListener.Addr()
+}
+
+// Player returns the proxy of the player in the given slot. Slots start at 1.
+func (s *WorldServer) Player(slot int) PlayerProxy {
+	return s.playerProxies[slot-1]
+}
+
+func (s *WorldServer) acceptClients(listener Listener, isJson bool) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			// The listener is closed, or something is very wrong with it.
+			log.Println(err)
+			return
+		}
+		if isJson {
+			conn = &jsonConn{conn}
+		}
+
+		// Don't let a slow client stop others from connecting.
+		go s.handshake(conn)
+	}
+}
+
+func (s *WorldServer) handshake(conn Conn) {
+	slotTaken := int64(0)
+	hello, err := ServerHandshakeFunc(conn, func(hello Handshake) (int64, string) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		slot, reason := s.assignSlot(hello)
+		if reason == "" && hello.Role == RolePlayer {
+			s.taken[slot-1] = true
+			slotTaken = slot
+		}
+		return slot, reason
+	})
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err != nil {
+		log.Printf("rejected client at %s: %v", s.Endpoint, err)
+		conn.Close()
+		if slotTaken > 0 {
+			s.taken[slotTaken-1] = false
+		}
+		return
+	}
+
+	if hello.Role == RolePlayer {
+		s.players[hello.Slot-1] = conn
+		s.slotFilled.Broadcast()
+		log.Printf("player %d joined", hello.Slot)
+	} else {
+		sp := &spectator{conn, make(chan frameWorld, 1)}
+		s.spectators = append(s.spectators, sp)
+		go s.sendToSpectator(sp)
+		log.Printf("spectator joined, %d spectators", len(s.spectators))
+	}
+}
+
+// Must be called with the mutex locked.
+func (s *WorldServer) assignSlot(hello Handshake) (slot int64, reason string) {
+	switch hello.Role {
+	case RolePlayer:
+		if hello.Slot == 0 {
+			for i := range s.players {
+				if !s.taken[i] {
+					return int64(i + 1), ""
+				}
+			}
+			return 0, "all player slots are taken"
+		}
+		if hello.Slot < 1 || hello.Slot > int64(len(s.players)) {
+			return 0, fmt.Sprintf("there is no player slot %d, there are "+
+				"%d player slots", hello.Slot, len(s.players))
+		}
+		if s.taken[hello.Slot-1] {
+			return 0, fmt.Sprintf("player slot %d is taken", hello.Slot)
+		}
+		return hello.Slot, ""
+	case RoleSpectator:
+		return 0, ""
+	default:
+		return 0, fmt.Sprintf("the world takes players and spectators, "+
+			"not a %s", hello.Role)
+	}
+}
+
+// Block until the slot has a player.
+func (s *WorldServer) waitForPlayer(slot int) Conn {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for s.players[slot-1] == nil {
+		s.slotFilled.Wait()
+	}
+	return s.players[slot-1]
+}
+
+// WaitForPlayers blocks until every player slot has a player, so that the
+// game doesn't start without them.
+func (s *WorldServer) WaitForPlayers() {
+	for slot := 1; slot <= len(s.players); slot++ {
+		s.waitForPlayer(slot)
+	}
+}
+
+// Free the slot, so that a player can take it again.
+func (s *WorldServer) dropPlayer(slot int, conn Conn) {
+	conn.Close()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.players[slot-1] == conn {
+		s.players[slot-1] = nil
+		s.taken[slot-1] = false
+		log.Printf("player %d left", slot)
+	}
+}
+
+// How long a spectator has to take a world before it is dropped.
+const spectatorWriteTimeout = 100 * time.Millisecond
+
+// A spectator gets the worlds from a goroutine of its own, so that a slow
+// spectator doesn't hold up the world. The world only leaves its latest
+// world for the goroutine, a spectator that is still busy with an older one
+// skips the worlds in between.
+type spectator struct {
+	conn   Conn
+	worlds chan frameWorld // Holds the latest world, if it wasn't sent yet.
+}
+
+// SendWorldToSpectators gives the world to every spectator. It doesn't wait
+// for anyone, a spectator that doesn't keep up is dropped.
+func (s *WorldServer) SendWorldToSpectators(w *World, frameIdx int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.spectators) == 0 {
+		return
+	}
+
+	// The spectators only read the world, they can share a copy.
+	fw := frameWorld{copyWorld(w), frameIdx}
+	for _, sp := range s.spectators {
+		// Replace the world the spectator didn't take yet, if there is one.
+		select {
+		case <-sp.worlds:
+		default:
+		}
+		sp.worlds <- fw
+	}
+}
+
+func (s *WorldServer) sendToSpectator(sp *spectator) {
+	// The spectator may skip worlds, so it needs an encoder of its own,
+	// which starts with the whole world.
+	var encoder worldEncoder
+	for fw := range sp.worlds {
+		var message []byte
+		if isJsonConn(sp.conn) {
+			// The bots that talk JSON always get the whole world.
+			message = marshalJsonWorld(fw.w, fw.frameIdx, 0)
+		} else {
+			message = encoder.Encode(fw.w, fw.frameIdx)
+		}
+		if err := sp.conn.WriteMessage(message,
+			spectatorWriteTimeout); err != nil {
+			sp.conn.Close()
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			s.spectators = slices.DeleteFunc(s.spectators,
+				func(other *spectator) bool { return other == sp })
+			log.Printf("spectator left, %d spectators", len(s.spectators))
+			return
+		}
+	}
+	// The server is closed.
+	sp.conn.Close()
+}
+
+// This is the same as PlayerProxyTcpIp, for a player slot of a WorldServer.
+type worldServerPlayer struct {
+	server  *WorldServer
+	slot    int
+	conn    Conn // The connection the encoder encodes for.
+	encoder worldEncoder
+}
+
+func (p *worldServerPlayer) SendWorldGetInput(w *World, frameIdx int) *PlayerInput {
+	// Keep trying to perform the transaction.
+	for {
+		// If we don't have a peer, wait until we get one.
+		conn := p.server.waitForPlayer(p.slot)
+		if conn != p.conn {
+			// The new peer has no world yet.
+			p.conn = conn
+			p.encoder.Reset()
+		}
+
+		// Try sending the world to our peer.
+		var data []byte
+		if isJsonConn(conn) {
+			data = marshalJsonWorld(w, frameIdx, p.slot)
+		} else {
+			data = p.encoder.Encode(w, frameIdx)
+		}
+		if err := conn.WriteMessage(data, 0); err != nil {
+			// There was an error. Nevermind, free the slot and wait for a
+			// player to take it again.
+			p.server.dropPlayer(p.slot, conn)
+			continue
+		}
+
+		// Try to get data from our peer.
+		input, err := readInputForFrame(conn, frameIdx,
+			fmt.Sprintf("player %d", p.slot))
+		if err != nil {
+			p.server.dropPlayer(p.slot, conn)
+			continue
+		}
+
+		// Finally, we can return the input.
+		return input
+	}
+}
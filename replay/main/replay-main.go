@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	. "playful-patterns.com/bakoko/ai"
+	. "playful-patterns.com/bakoko/replay"
+	. "playful-patterns.com/bakoko/world"
+	. "playful-patterns.com/bakoko/world/world-run"
+	"sort"
+	"time"
+)
+
+// Replay one or more recordings without a GUI and print the final state of
+// the world for each of them.
+// Arguments can be .bkk files or folders containing .bkk files.
+// This is meant for checking that changes to the simulation don't change
+// the outcome of existing playthroughs. If a recording has a checksum file
+// next to it or contains its own checksums, the checksum of every frame is
+// verified and the first frame where the simulation diverges is reported.
+// A checksum file takes precedence over the checksums inside a recording.
+// The players after the first one replay their recorded inputs, unless the
+// recording doesn't have them or -simulate-ai is given, in which case the
+// current AI plays them.
+func main() {
+	writeChecksums := flag.Bool("write-checksums", false,
+		"overwrite the checksum file of each recording with the checksums "+
+			"produced by the current simulation")
+	simulateAi := flag.Bool("simulate-ai", false,
+		"let the current AI play the players after the first one instead of "+
+			"replaying their recorded inputs")
+	flag.Usage = func() {
+		fmt.Println("usage: replay-main [-write-checksums] [-simulate-ai] <recording.bkk | folder>...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var recordingFiles []string
+	for _, arg := range flag.Args() {
+		recordingFiles = append(recordingFiles, getRecordingFiles(arg)...)
+	}
+
+	totalFrames := 0
+	nMismatches := 0
+	var totalDuration time.Duration
+	for _, recordingFile := range recordingFiles {
+		recording := DeserializeRecording(recordingFile)
+		player2Source := DefaultPlayer2Source(recording)
+		if *simulateAi {
+			player2Source = Player2Simulated
+		}
+		r := ReplayRecording(recording, player2Source)
+		fmt.Printf("\n%s\n", recordingFile)
+		fmt.Printf("  version: %d AI: %s\n", recording.Version, recording.AIIdentity)
+		if player2Source == Player2Recorded {
+			fmt.Printf("  other players' inputs: recorded\n")
+		} else {
+			fmt.Printf("  other players' inputs: simulated by %s\n", (&PlayerAI{}).Identity())
+		}
+		fmt.Printf("  frames: %d duration: %v\n", r.NFrames, r.Duration)
+		printWorld(&r.World)
+		printEvents(r.Events)
+		if len(r.Checksums) > 0 {
+			fmt.Printf("  final checksum: %016x\n", r.Checksums[len(r.Checksums)-1])
+		}
+
+		checksumFile := ChecksumFile(recordingFile)
+		if *writeChecksums {
+			SerializeChecksums(r.Checksums, checksumFile)
+			fmt.Printf("  checksums written to %s\n", checksumFile)
+		} else if FileExists(checksumFile) {
+			if !verifyChecksums(DeserializeChecksums(checksumFile), r.Checksums) {
+				nMismatches++
+			}
+		} else if len(recording.Checksums) > 0 {
+			if !verifyChecksums(recording.Checksums, r.Checksums) {
+				nMismatches++
+			}
+		} else {
+			fmt.Printf("  no checksums to verify\n")
+		}
+
+		totalFrames += r.NFrames
+		totalDuration += r.Duration
+	}
+	fmt.Printf("\nreplayed %d recordings, %d frames in %v\n",
+		len(recordingFiles), totalFrames, totalDuration)
+
+	if nMismatches > 0 {
+		fmt.Printf("%d recordings diverged from their checksums\n", nMismatches)
+		os.Exit(2)
+	}
+}
+
+func verifyChecksums(expected []uint64, actual []uint64) bool {
+	frameIdx := FirstDivergingFrame(expected, actual)
+	if frameIdx < 0 {
+		fmt.Printf("  checksums OK\n")
+		return true
+	}
+
+	if frameIdx >= len(expected) || frameIdx >= len(actual) {
+		fmt.Printf("  CHECKSUM MISMATCH: expected %d frames, replayed %d frames\n",
+			len(expected), len(actual))
+	} else {
+		fmt.Printf("  CHECKSUM MISMATCH at frame %d: expected %016x got %016x\n",
+			frameIdx, expected[frameIdx], actual[frameIdx])
+	}
+	return false
+}
+
+func getRecordingFiles(path string) []string {
+	info, err := os.Stat(path)
+	Check(err)
+	if !info.IsDir() {
+		return []string{path}
+	}
+
+	files, err := filepath.Glob(filepath.Join(path, "*.bkk"))
+	Check(err)
+	sort.Strings(files)
+	return files
+}
+
+func printPlayer(name string, p *Player) {
+	fmt.Printf("  %s: pos (%d, %d) health %d balls %d state %d\n", name,
+		p.Bounds.Center.X.ToInt64(), p.Bounds.Center.Y.ToInt64(),
+		p.Health.ToInt64(), p.NBalls.ToInt64(), p.State.ToInt64())
+}
+
+func printEvents(events []Event) {
+	fmt.Printf("  events:")
+	for _, t := range EventTypes {
+		fmt.Printf(" %s %d", t, len(EventsOf(events, t)))
+	}
+	fmt.Printf("\n")
+}
+
+func printWorld(w *World) {
+	for i := range w.Players {
+		printPlayer(fmt.Sprintf("player%d", i+1), &w.Players[i])
+	}
+	fmt.Printf("  balls: %d\n", len(w.Balls))
+	for _, b := range w.Balls {
+		fmt.Printf("    type %d pos (%d, %d) speed %d\n", b.Type.ToInt64(),
+			b.Bounds.Center.X.ToInt64(), b.Bounds.Center.Y.ToInt64(),
+			b.Speed.ToInt64())
+	}
+}
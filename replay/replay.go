@@ -0,0 +1,53 @@
+package replay
+
+import (
+	"bytes"
+	. "playful-patterns.com/bakoko/ai"
+	. "playful-patterns.com/bakoko/world"
+	. "playful-patterns.com/bakoko/world/world-run"
+	"time"
+)
+
+type ReplayResult struct {
+	NFrames   int
+	Duration  time.Duration
+	World     World
+	Checksums []uint64
+	// Everything that happened during the replay, frame after frame.
+	Events []Event
+}
+
+// Replay a recording without any interface, as fast as possible.
+// The first player is driven by the recorded inputs. The other players are
+// driven either by their recorded inputs or by fresh PlayerAIs, exactly like
+// in FusedPlay mode.
+func ReplayRecording(recording *Recording, player2Source Player2Source) (r ReplayResult) {
+	var worldRunner WorldRunner
+	var ais PlayerAIs
+	worldRunner.InitializePlayback(recording)
+
+	start := time.Now()
+	for i := range recording.Inputs {
+		// First, get the reactions of both players to the current world.
+		var input Input
+		if player2Source == Player2Recorded {
+			input = recording.Inputs[i]
+		} else {
+			if aiState := worldRunner.GetLoadedAIState(); aiState != nil {
+				ais.Deserialize(bytes.NewBuffer(aiState))
+			}
+			recorded := recording.Inputs[i]
+			input.Players = append([]PlayerInput{recorded.Player(0)},
+				ais.Step(worldRunner.GetWorld(), i)...)
+		}
+
+		// Second, use their reactions to update the world.
+		worldRunner.Step(input)
+		r.Events = append(r.Events, worldRunner.GetWorld().Events...)
+	}
+	r.Duration = time.Since(start)
+	r.NFrames = len(recording.Inputs)
+	r.World = *worldRunner.GetWorld()
+	r.Checksums = worldRunner.GetChecksums()
+	return
+}
@@ -0,0 +1,41 @@
+package replay
+
+import (
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"playful-patterns.com/bakoko/internal/worldtest"
+	. "playful-patterns.com/bakoko/world"
+	. "playful-patterns.com/bakoko/world/world-run"
+	"testing"
+)
+
+func testWorldConfig() WorldConfig {
+	return WorldConfig{WorldJson: worldtest.WorldJson, Level: worldtest.Level}
+}
+
+// A recorded run replays to the same worlds, frame after frame.
+func TestReplayRecording(t *testing.T) {
+	recordingFile := filepath.Join(t.TempDir(), "recording.bkk")
+	var wr WorldRunner
+	wr.InitializeLockstep(recordingFile, 42, testWorldConfig())
+	for i := 0; i < 100; i++ {
+		input := Input{Players: make([]PlayerInput, 2)}
+		input.Players[0].MoveRight = i < 50
+		input.Players[0].Shoot = i%10 == 0
+		input.Players[0].ShootPt = IPt(i*10, 500)
+		input.Players[1].MoveLeft = i >= 50
+		input.Players[1].Shoot = i%15 == 0
+		input.Players[1].ShootPt = IPt(0, i*10)
+		wr.Step(input)
+	}
+	wr.Close()
+
+	recording := DeserializeRecording(recordingFile)
+	assert.Equal(t, 100, len(recording.Inputs))
+	assert.Equal(t, wr.GetChecksums(), recording.Checksums)
+
+	r := ReplayRecording(recording, Player2Recorded)
+	assert.Equal(t, 100, r.NFrames)
+	assert.Equal(t, wr.GetChecksums(), r.Checksums)
+	assert.Equal(t, wr.GetWorld().Serialize(), r.World.Serialize())
+}
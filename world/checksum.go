@@ -0,0 +1,71 @@
+package world
+
+import (
+	"bytes"
+	"hash/fnv"
+	. "playful-patterns.com/bakoko/ints"
+)
+
+// Checksum computes a hash of the state of the world that the simulation
+// evolves: the players, the balls, the obstacles and JustReloaded.
+// A world with two players without teams hashes like it did when worlds
+// always had two players, so that old recordings keep their checksums.
+// Since the simulation is deterministic, replaying the same inputs must
+// always produce the same sequence of checksums. If a refactoring changes
+// the checksum of any frame, the refactoring changed the behavior.
+func (w *World) Checksum() uint64 {
+	buf := new(bytes.Buffer)
+	legacy := len(w.Players) == 2
+	for i := range w.Players {
+		Serialize(buf, newLegacyPlayer(w.Players[i]))
+		legacy = legacy && w.Players[i].Team.Eq(ZERO)
+	}
+	SerializeSlice(buf, w.Balls)
+	w.Obstacles.Serialize(buf)
+	Serialize(buf, w.JustReloaded)
+	if !legacy {
+		Serialize(buf, int64(len(w.Players)))
+		for i := range w.Players {
+			Serialize(buf, w.Players[i].Team)
+		}
+	}
+
+	h := fnv.New64a()
+	_, err := h.Write(buf.Bytes())
+	Check(err)
+	return h.Sum64()
+}
+
+// ChecksumFile returns the file which stores the checksums that belong to a
+// recording.
+func ChecksumFile(recordingFile string) string {
+	return recordingFile + ".sum"
+}
+
+func SerializeChecksums(checksums []uint64, filename string) {
+	buf := new(bytes.Buffer)
+	SerializeSlice(buf, checksums)
+	Zip(filename, buf.Bytes())
+}
+
+func DeserializeChecksums(filename string) (checksums []uint64) {
+	buf := bytes.NewBuffer(Unzip(filename))
+	DeserializeSlice(buf, &checksums)
+	return
+}
+
+// FirstDivergingFrame compares the checksums of two runs and returns the
+// first frame where they differ, or -1 if they are identical.
+// If one run is a prefix of the other, the first frame that exists in only
+// one of them is the diverging frame.
+func FirstDivergingFrame(expected []uint64, actual []uint64) int {
+	for i := 0; i < len(expected) && i < len(actual); i++ {
+		if expected[i] != actual[i] {
+			return i
+		}
+	}
+	if len(expected) != len(actual) {
+		return min(len(expected), len(actual))
+	}
+	return -1
+}
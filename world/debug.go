@@ -44,10 +44,16 @@ func (d *DebugInfo) Serialize() []byte {
 }
 
 func (d *DebugInfo) Deserialize(buf *bytes.Buffer) {
-	DeserializeSlice(buf, &d.Points)
-	DeserializeSlice(buf, &d.Lines)
-	DeserializeSlice(buf, &d.Circles)
-	DeserializeSlice(buf, &d.Squares)
+	r := Reader{Buf: buf}
+	d.Read(&r)
+	Check(r.Err)
+}
+
+func (d *DebugInfo) Read(r *Reader) {
+	ReadSlice(r, &d.Points)
+	ReadSlice(r, &d.Lines)
+	ReadSlice(r, &d.Circles)
+	ReadSlice(r, &d.Squares)
 }
 
 func (d *DebugInfo) Clone() (c DebugInfo) {
@@ -0,0 +1,84 @@
+package world
+
+import (
+	"fmt"
+	. "playful-patterns.com/bakoko/ints"
+)
+
+// EventType says what happened in an Event.
+type EventType int64
+
+const (
+	EventBallShot       EventType = iota + 1 // A player shot a ball.
+	EventPlayerHit                           // A ball hit a player that isn't its friend.
+	EventBallCollected                       // A player collected a friendly ball.
+	EventBallBounced                         // A ball bounced off an obstacle.
+	EventPlayerStunned                       // A hit took a health point from a player.
+	EventPlayerDefeated                      // A hit took the last health point of a player.
+)
+
+// EventTypes lists every type of event, in the order of their values.
+var EventTypes = []EventType{EventBallShot, EventPlayerHit, EventBallCollected,
+	EventBallBounced, EventPlayerStunned, EventPlayerDefeated}
+
+func (t EventType) String() string {
+	switch t {
+	case EventBallShot:
+		return "BallShot"
+	case EventPlayerHit:
+		return "PlayerHit"
+	case EventBallCollected:
+		return "BallCollected"
+	case EventBallBounced:
+		return "BallBounced"
+	case EventPlayerStunned:
+		return "PlayerStunned"
+	case EventPlayerDefeated:
+		return "PlayerDefeated"
+	}
+	return fmt.Sprintf("EventType(%d)", int64(t))
+}
+
+// Event is something that happened during a step of the world. The GUI
+// animates them, the AI can react to them and analytics can count them,
+// without having to guess what happened by comparing two worlds.
+// World.Step makes the events in the same order every time it gets the same
+// world and the same input, so they are as deterministic as the world.
+type Event struct {
+	Type     EventType
+	FrameIdx int64
+	// The index in World.Players of the player that shot, was hit,
+	// collected, was stunned or was defeated. -1 for a bounce.
+	Player int64
+	// The type of the ball that was shot, hit, was collected or bounced.
+	// ZERO for the events that are only about a player.
+	BallType Int
+	// Where the ball was, or where the player was for the events that are
+	// only about a player.
+	Pos Pt
+}
+
+// The index of a player of the world, -1 if the player is not part of the
+// world.
+func (w *World) playerIdx(player *Player) int64 {
+	for i := range w.Players {
+		if &w.Players[i] == player {
+			return int64(i)
+		}
+	}
+	return -1
+}
+
+func (w *World) addEvent(t EventType, player int64, ballType Int, pos Pt) {
+	w.Events = append(w.Events, Event{t, 0, player, ballType, pos})
+}
+
+// EventsOf returns the events of a certain type, in the order they happened.
+func EventsOf(events []Event, t EventType) (filtered []Event) {
+	for _, e := range events {
+		if e.Type == t {
+			filtered = append(filtered, e)
+		}
+	}
+	return
+}
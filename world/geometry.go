@@ -583,3 +583,63 @@ func CircleSquaresCollision(circleOldPos Pt, circleNewPos Pt,
 
 	return intersectsAny, circlePositionAtCollision, collisionNormal
 }
+
+// CircleCircleCollision tells where a circle travelling from circleOldPos to
+// circleNewPos starts touching another circle, which stays in place.
+// Like for the squares, the other circle is grown by the travelling circle
+// (the Minkowski sum) so that the travelling circle can be considered a point
+// which travels on a line. The first intersection of the line with the grown
+// circle is where the circles start touching.
+// A circle that already touches the other circle at circleOldPos collides
+// right there.
+// The returned position is moved collisionNudge into the other circle, so
+// that CirclesIntersect agrees that the circles touch despite the rounding
+// errors of LineCircleIntersection3Factors.
+func CircleCircleCollision(circleOldPos Pt, circleNewPos Pt,
+	circleDiameter Int, other Circle) (intersects bool,
+	circlePositionAtCollision Pt) {
+	if CirclesIntersect(Circle{circleOldPos, circleDiameter}, other) {
+		return true, circleOldPos
+	}
+
+	grown := Circle{other.Center, other.Diameter.Plus(circleDiameter)}
+	intersects, circlePositionAtCollision =
+		LineCircleIntersection3Factors(Line{circleOldPos, circleNewPos}, grown)
+	if !intersects {
+		return false, Pt{}
+	}
+
+	inwards := circlePositionAtCollision.To(other.Center)
+	inwards.SetLen(I(collisionNudge))
+	circlePositionAtCollision.Add(inwards)
+	return true, circlePositionAtCollision
+}
+
+// LineCircleIntersection3Factors snaps an intersection that is up to 10 units
+// outside the line to the end of the line, and its integer divisions and
+// square root are off by a few more units. So the position where a circle
+// starts touching another can be up to about 13 units short of touching it.
+// 20 is more than that, and still too little to be seen.
+const collisionNudge = 20
+
+// CircleCirclesCollision returns the index of the circle that the travelling
+// circle touches first, or -1 if it touches none of them.
+func CircleCirclesCollision(circleOldPos Pt, circleNewPos Pt,
+	circleDiameter Int, circles []Circle) (idx int,
+	circlePositionAtCollision Pt) {
+
+	idx = -1
+	minDist := I(math.MaxInt64)
+	for i, c := range circles {
+		intersects, pt := CircleCircleCollision(circleOldPos, circleNewPos,
+			circleDiameter, c)
+
+		dist := circleOldPos.SquaredDistTo(pt)
+		if intersects && dist.Lt(minDist) {
+			minDist = dist
+			circlePositionAtCollision = pt
+			idx = i
+		}
+	}
+	return idx, circlePositionAtCollision
+}
@@ -0,0 +1,52 @@
+package world
+
+import (
+	"github.com/stretchr/testify/assert"
+	. "playful-patterns.com/bakoko/ints"
+	"testing"
+)
+
+func TestCircleCircleCollision(t *testing.T) {
+	other := Circle{IPt(20000, 10000), I(5000)}
+
+	// The circle ends up past the other circle, it only touches it on the
+	// way.
+	intersects, pos := CircleCircleCollision(IPt(10000, 10000),
+		IPt(30000, 10000), I(3700), other)
+	assert.True(t, intersects)
+	assert.True(t, CirclesIntersect(Circle{pos, I(3700)}, other))
+	assert.InDelta(t, 20000-4350, pos.X.ToInt64(), 50)
+	assert.Equal(t, I(10000), pos.Y)
+
+	// The circle passes by.
+	intersects, _ = CircleCircleCollision(IPt(10000, 5000), IPt(30000, 5000),
+		I(3700), other)
+	assert.False(t, intersects)
+
+	// The circle falls short.
+	intersects, _ = CircleCircleCollision(IPt(10000, 10000),
+		IPt(15000, 10000), I(3700), other)
+	assert.False(t, intersects)
+
+	// The circle touches the other circle before it moves.
+	intersects, pos = CircleCircleCollision(IPt(17000, 10000),
+		IPt(30000, 10000), I(3700), other)
+	assert.True(t, intersects)
+	assert.Equal(t, IPt(17000, 10000), pos)
+}
+
+func TestCircleCirclesCollision(t *testing.T) {
+	circles := []Circle{
+		{IPt(25000, 10000), I(5000)},
+		{IPt(20000, 20000), I(5000)},
+		{IPt(20000, 10000), I(5000)},
+	}
+	idx, pos := CircleCirclesCollision(IPt(10000, 10000), IPt(30000, 10000),
+		I(3700), circles)
+	assert.Equal(t, 2, idx)
+	assert.True(t, CirclesIntersect(Circle{pos, I(3700)}, circles[2]))
+
+	idx, _ = CircleCirclesCollision(IPt(10000, 10000), IPt(30000, 10000),
+		I(3700), circles[1:2])
+	assert.Equal(t, -1, idx)
+}
@@ -0,0 +1,154 @@
+package world
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Before anything else is sent over a connection, the client says who it is
+// and the server says if it accepts it. Without this, a client built from
+// older code would get a world in a layout it doesn't know and silently
+// misread it.
+// The handshake is JSON, so that any version can read the handshake of any
+// other version and say what is wrong.
+
+// ProtocolVersion must change whenever the messages exchanged by the modules
+// change (for example, when World.Serialize changes).
+// Version 2 added frame indexes to worlds and inputs.
+// Version 3 sends only what changed in the world since the previous world.
+// Version 4 has worlds with any number of players.
+// Version 5 sends the events of each step along with the world.
+const ProtocolVersion = 5
+
+// Role is what the client wants to be for the server.
+type Role string
+
+const (
+	RolePlayer    Role = "player"
+	RoleSpectator Role = "spectator"
+	RolePainter   Role = "painter"
+	// The other player, in lockstep mode.
+	RolePeer Role = "peer"
+)
+
+// The first message on a connection, sent by the client.
+type Handshake struct {
+	ProtocolVersion int64
+	Role            Role
+	BuildHash       string
+	// The slot the client wants, for servers that have more than one (like
+	// the player slots of a world server). 0 means any free slot.
+	Slot int64
+}
+
+// The answer of the server to a Handshake.
+type HandshakeReply struct {
+	Accepted        bool
+	Reason          string
+	ProtocolVersion int64
+	BuildHash       string
+	// The slot the client got. The client asks for the same slot when it
+	// reconnects, to continue where it left off.
+	Slot int64
+}
+
+var ErrHandshakeRejected = errors.New("rejected")
+
+// How long a server waits for a client to say who it is.
+const HandshakeTimeout = 5 * time.Second
+
+// ClientHandshake introduces the client to the server as the given role,
+// asking for the given slot. It returns the slot the client got.
+// It fails with ErrHandshakeRejected if the server doesn't accept the
+// client, and the error says why.
+func ClientHandshake(conn Conn, role Role, slot int64,
+	timeout time.Duration) (int64, error) {
+	hello := Handshake{ProtocolVersion, role, BuildHash(), slot}
+	data, err := json.Marshal(hello)
+	Check(err)
+	if err = conn.WriteMessage(data, timeout); err != nil {
+		return 0, err
+	}
+
+	data, err = conn.ReadMessage(timeout)
+	if err != nil {
+		return 0, err
+	}
+	var reply HandshakeReply
+	if err = json.Unmarshal(data, &reply); err != nil {
+		return 0, &TransportError{"handshake", "",
+			fmt.Errorf("%w: %w", ErrMalformedMessage, err)}
+	}
+	if !reply.Accepted {
+		return 0, &TransportError{"handshake", "",
+			fmt.Errorf("%w: %s", ErrHandshakeRejected, reply.Reason)}
+	}
+	logBuildHashMismatch("server", reply.BuildHash)
+	return reply.Slot, nil
+}
+
+// ServerHandshake waits for a client to introduce itself and accepts it if
+// it speaks our protocol and has the role the server expects.
+// A client that is rejected is told why, so that it can show it.
+func ServerHandshake(conn Conn, role Role) error {
+	_, err := ServerHandshakeFunc(conn, func(hello Handshake) (int64, string) {
+		if hello.Role != role {
+			return 0, fmt.Sprintf("role mismatch: the client wants to be "+
+				"a %s, the server expects a %s", hello.Role, role)
+		}
+		return 0, ""
+	})
+	return err
+}
+
+// ServerHandshakeFunc is ServerHandshake for servers that take more than one
+// role or have slots. If the client speaks our protocol, decide says which
+// slot the client gets, or why it is rejected (if the reason is not empty).
+func ServerHandshakeFunc(conn Conn,
+	decide func(hello Handshake) (slot int64, reason string)) (Handshake, error) {
+	var hello Handshake
+	data, err := conn.ReadMessage(HandshakeTimeout)
+	if err != nil {
+		return hello, err
+	}
+
+	reply := HandshakeReply{true, "", ProtocolVersion, BuildHash(), 0}
+	if err = json.Unmarshal(data, &hello); err != nil {
+		reply.Reason = "expected a handshake, the client is probably " +
+			"built from older code"
+	} else if hello.ProtocolVersion != ProtocolVersion {
+		reply.Reason = fmt.Sprintf("protocol version mismatch: the client "+
+			"has version %d (build %s), the server has version %d (build %s)",
+			hello.ProtocolVersion, hello.BuildHash, ProtocolVersion,
+			BuildHash())
+	} else {
+		reply.Slot, reply.Reason = decide(hello)
+	}
+	reply.Accepted = reply.Reason == ""
+
+	data, err = json.Marshal(reply)
+	Check(err)
+	if err = conn.WriteMessage(data, HandshakeTimeout); err != nil {
+		return hello, err
+	}
+
+	if !reply.Accepted {
+		return hello, &TransportError{"handshake", "",
+			fmt.Errorf("%w: %s", ErrHandshakeRejected, reply.Reason)}
+	}
+	logBuildHashMismatch("client", hello.BuildHash)
+	hello.Slot = reply.Slot
+	return hello, nil
+}
+
+// The protocol version says if we can talk to each other, but if the builds
+// differ, the peers may still behave differently. It's worth knowing.
+func logBuildHashMismatch(peer string, peerBuildHash string) {
+	if peerBuildHash != BuildHash() {
+		log.Printf("the %s is built from %s, we are built from %s", peer,
+			peerBuildHash, BuildHash())
+	}
+}
@@ -0,0 +1,63 @@
+package world
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// Connect a client and a server and let the server do its side of the
+// handshake.
+func testHandshakeConns(t *testing.T, role Role) (client Conn, serverErr chan error) {
+	var transport MemoryTransport
+	listener, err := transport.Listen("test")
+	assert.Nil(t, err)
+
+	serverErr = make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		assert.Nil(t, err)
+		serverErr <- ServerHandshake(conn, role)
+	}()
+	client, err = transport.Dial("test", time.Second)
+	assert.Nil(t, err)
+	return
+}
+
+func TestHandshake(t *testing.T) {
+	client, serverErr := testHandshakeConns(t, RolePlayer)
+	_, err := ClientHandshake(client, RolePlayer, 0, time.Second)
+	assert.Nil(t, err)
+	assert.Nil(t, <-serverErr)
+
+	client, serverErr = testHandshakeConns(t, RolePlayer)
+	_, err = ClientHandshake(client, RolePainter, 0, time.Second)
+	assert.ErrorIs(t, err, ErrHandshakeRejected)
+	assert.ErrorContains(t, err, "role mismatch")
+	assert.ErrorIs(t, <-serverErr, ErrHandshakeRejected)
+}
+
+func TestHandshake_Rejected(t *testing.T) {
+	// A client from the future.
+	client, serverErr := testHandshakeConns(t, RolePlayer)
+	data, _ := json.Marshal(Handshake{ProtocolVersion + 1, RolePlayer, "x", 0})
+	assert.Nil(t, client.WriteMessage(data, time.Second))
+	data, err := client.ReadMessage(time.Second)
+	assert.Nil(t, err)
+	var reply HandshakeReply
+	assert.Nil(t, json.Unmarshal(data, &reply))
+	assert.False(t, reply.Accepted)
+	assert.Contains(t, reply.Reason, "protocol version mismatch")
+	assert.ErrorIs(t, <-serverErr, ErrHandshakeRejected)
+
+	// A client from before there was a handshake, it sends an input right
+	// away.
+	client, serverErr = testHandshakeConns(t, RolePlayer)
+	assert.Nil(t, client.WriteMessage([]byte{1, 0, 0, 0}, time.Second))
+	data, err = client.ReadMessage(time.Second)
+	assert.Nil(t, err)
+	assert.Nil(t, json.Unmarshal(data, &reply))
+	assert.False(t, reply.Accepted)
+	assert.ErrorIs(t, <-serverErr, ErrHandshakeRejected)
+}
@@ -0,0 +1,159 @@
+package world
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MemoryTransport carries messages over channels, inside the same process.
+// It behaves like TcpTransport as far as the proxies can tell, so tests can
+// connect the modules without opening real ports.
+// The zero value is ready to use.
+type MemoryTransport struct {
+	// Messages bigger than this are refused. 0 means DefaultMaxMessageSize.
+	MaxMessageSize int64
+	mutex          sync.Mutex
+	listeners      map[string]*memoryListener
+}
+
+// How many messages can be written to a connection before the writer has to
+// wait for the reader. Like the buffers of a socket.
+const memoryConnBufferSize = 16
+
+func (t *MemoryTransport) Listen(endpoint string) (Listener, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.listeners == nil {
+		t.listeners = map[string]*memoryListener{}
+	}
+	if _, ok := t.listeners[endpoint]; ok {
+		return nil, &TransportError{"listen", endpoint, ErrEndpointInUse}
+	}
+
+	l := &memoryListener{
+		transport: t,
+		endpoint:  endpoint,
+		conns:     make(chan Conn),
+		closed:    make(chan struct{}),
+	}
+	t.listeners[endpoint] = l
+	return l, nil
+}
+
+func (t *MemoryTransport) Dial(endpoint string, timeout time.Duration) (Conn, error) {
+	t.mutex.Lock()
+	l, ok := t.listeners[endpoint]
+	t.mutex.Unlock()
+	if !ok {
+		return nil, &TransportError{"dial", endpoint, ErrNoConnection}
+	}
+
+	// Connect two ends so that what one writes, the other reads.
+	aToB := make(chan []byte, memoryConnBufferSize)
+	bToA := make(chan []byte, memoryConnBufferSize)
+	p := &memoryPipe{closed: make(chan struct{})}
+	max := maxMessageSize(t.MaxMessageSize)
+	client := &memoryConn{in: bToA, out: aToB, pipe: p, maxMessageSize: max}
+	server := &memoryConn{in: aToB, out: bToA, pipe: p, maxMessageSize: max}
+
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, &TransportError{"dial", endpoint, ErrNoConnection}
+	case <-TimeoutChan(timeout):
+		return nil, &TransportError{"dial", endpoint, ErrTimeout}
+	}
+}
+
+type memoryListener struct {
+	transport *MemoryTransport
+	endpoint  string
+	conns     chan Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memoryListener) Accept() (Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, &TransportError{"accept", l.endpoint, ErrClosed}
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.transport.mutex.Lock()
+		delete(l.transport.listeners, l.endpoint)
+		l.transport.mutex.Unlock()
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() string {
+	return l.endpoint
+}
+
+// The two ends of a connection share the pipe, so that closing one end
+// closes the other one as well.
+type memoryPipe struct {
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type memoryConn struct {
+	in             <-chan []byte
+	out            chan<- []byte
+	pipe           *memoryPipe
+	maxMessageSize int64
+}
+
+func (c *memoryConn) ReadMessage(timeout time.Duration) ([]byte, error) {
+	select {
+	case data := <-c.in:
+		return data, nil
+	case <-c.pipe.closed:
+		return nil, &TransportError{"read", "", ErrClosed}
+	case <-TimeoutChan(timeout):
+		return nil, &TransportError{"read", "", ErrTimeout}
+	}
+}
+
+func (c *memoryConn) WriteMessage(data []byte, timeout time.Duration) error {
+	if int64(len(data)) > c.maxMessageSize {
+		return &TransportError{"write", "", fmt.Errorf(
+			"%w: %d bytes, the limit is %d", ErrMessageTooLarge, len(data),
+			c.maxMessageSize)}
+	}
+
+	// Copy the data, the caller may reuse its slice after we return.
+	message := make([]byte, len(data))
+	copy(message, data)
+
+	// Don't write to a closed connection, even if there is room in the
+	// buffer.
+	select {
+	case <-c.pipe.closed:
+		return &TransportError{"write", "", ErrClosed}
+	default:
+	}
+
+	select {
+	case c.out <- message:
+		return nil
+	case <-c.pipe.closed:
+		return &TransportError{"write", "", ErrClosed}
+	case <-TimeoutChan(timeout):
+		return &TransportError{"write", "", ErrTimeout}
+	}
+}
+
+func (c *memoryConn) Close() error {
+	c.pipe.closeOnce.Do(func() { close(c.pipe.closed) })
+	return nil
+}
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
+	"maps"
+	. "playful-patterns.com/bakoko/ai"
 	. "playful-patterns.com/bakoko/proxy"
 	. "playful-patterns.com/bakoko/world"
 	. "playful-patterns.com/bakoko/world/world-run"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // 3 possible run modes: FusedRecording, FusedPlayback, SplitRecording
@@ -12,25 +19,172 @@ import (
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 
-	player1 := PlayerProxyTcpIp{}
-	player1.Endpoint = "localhost:56901"
-	player2 := PlayerProxyTcpIp{}
-	player2.Endpoint = "localhost:56902"
-	guiProxy := GuiProxyTcpIp{}
-	guiProxy.Endpoint = "localhost:56903"
+	// Players and spectators all connect to the same endpoint.
+	endpoint := flag.String("endpoint", "localhost:56901",
+		"where players and spectators connect to the world")
+	jsonEndpoint := flag.String("json", "",
+		"where bots that talk JSON connect to the world, none if empty")
+	guiEndpoint := flag.String("gui", "localhost:56903",
+		"where the gui waits for the debug info of the world")
+	// The world moves on at a fixed rate, it doesn't wait for slow players.
+	tickRate := flag.Int("tick-rate", 60, "frames per second")
+	// A list with a value for each slot, like "15ms,30ms", or values for
+	// some slots only, like "2=30ms". Slots without a value get the default.
+	timeouts := flag.String("timeout", "",
+		"how long to wait for the input of each player, each frame, "+
+			"like 15ms,30ms or 2=30ms, 0 means as long as it takes "+
+			"(default 15ms)")
+	fallbacks := flag.String("fallback", "",
+		"what each player does when its input is late: repeat, idle or "+
+			"ai, like repeat,ai or 2=idle (default repeat)")
+	// Remote players can be anything, so the world doesn't take every input.
+	hostSlot := flag.Int("host", 1,
+		"the player that may reload and pause the game, 0 means nobody")
+	maxShots := flag.Int("max-shots-per-second", 10,
+		"how many shots a player may fire in a second, 0 means no limit")
+	flag.Parse()
 
 	var worldRunner WorldRunner
-	worldRunner.Initialize(GetNewRecordingFile(), false)
+	// The players are remote so we don't know which AI, if any, drives them.
+	worldRunner.Initialize(GetNewRecordingFile(), "remote", false)
+
+	// The world says how many players there are.
+	server := WorldServer{}
+	server.Endpoint = *endpoint
+	server.NPlayers = len(worldRunner.GetWorld().Players)
+	server.JsonEndpoint = *jsonEndpoint
+	Check(server.Initialize())
+	rules := InputRules{MaxShotsPerSecond: *maxShots, FrameRate: *tickRate}
+	var players []PlayerProxy
+	var validated []*ValidatedPlayer
+	slotTimeouts, err := parseSlotValues(*timeouts, server.NPlayers)
+	Check(err)
+	slotFallbacks, err := parseSlotValues(*fallbacks, server.NPlayers)
+	Check(err)
+	for slot := 1; slot <= server.NPlayers; slot++ {
+		timeout := 15 * time.Millisecond
+		if value, ok := slotTimeouts[slot]; ok {
+			timeout, err = time.ParseDuration(value)
+			Check(err)
+			if timeout < 0 {
+				Check(fmt.Errorf("the timeout of slot %d is negative: %v",
+					slot, timeout))
+			}
+		}
+		fallback := string(FallbackRepeat)
+		if value, ok := slotFallbacks[slot]; ok {
+			fallback = value
+		}
+		p := newValidatedPlayer(newTimedPlayer(&server, slot, timeout,
+			fallback), slot, *hostSlot, rules)
+		players = append(players, p)
+		validated = append(validated, p)
+	}
+	reported := make([]map[string]int, len(validated))
+	guiProxy := GuiProxyTcpIp{}
+	guiProxy.Endpoint = *guiEndpoint
+
+	// Once everyone is here, the world doesn't wait for anyone anymore.
+	server.WaitForPlayers()
+	ticker := time.NewTicker(time.Second / time.Duration(*tickRate))
 	for {
 		// First, send the current world to players and get their reactions.
+		// Blocks until the timeout of the slowest player, at most.
 		var input Input
-		input.Player1Input = *player1.SendWorldGetInput(worldRunner.GetWorld()) // Blocks.
-		input.Player2Input = *player2.SendWorldGetInput(worldRunner.GetWorld()) // Blocks.
+		input.Players = SendWorldGetInputs(worldRunner.GetWorld(),
+			worldRunner.GetFrameIdx(), players...)
 
 		// Second, use their reactions to update the world.
 		worldRunner.Step(input)
 
 		// Third, send any debug info generated by the step.
 		guiProxy.SendPaintData(worldRunner.GetDebugInfo())
+
+		// Fourth, show the new world to whoever is watching.
+		server.SendWorldToSpectators(worldRunner.GetWorld(),
+			worldRunner.GetFrameIdx())
+
+		// Now and then, say how often the players broke the rules. They only
+		// say it themselves the first time they break a rule.
+		if worldRunner.GetFrameIdx()%(60**tickRate) == 0 {
+			logRejections(validated, reported)
+		}
+
+		// Wait for the next frame.
+		<-ticker.C
+	}
+}
+
+// Logs how many inputs of each player broke each rule, for the players that
+// broke rules since the last time.
+func logRejections(players []*ValidatedPlayer, reported []map[string]int) {
+	for i, p := range players {
+		n := p.NRejected()
+		if !maps.Equal(n, reported[i]) {
+			log.Printf("%s broke the rules so far: %v", p.Name, n)
+			reported[i] = n
+		}
+	}
+}
+
+// Splits a list of values for slots, like "15ms,30ms" or "2=30ms,3=45ms",
+// into the value of each slot. A value without a slot is for the slot after
+// the previous value. A slot the world doesn't have is an error, so that a
+// typo doesn't quietly leave a player with the default.
+func parseSlotValues(list string, nPlayers int) (map[int]string, error) {
+	values := map[int]string{}
+	if list == "" {
+		return values, nil
+	}
+	slot := 0
+	for _, entry := range strings.Split(list, ",") {
+		slot++
+		value := entry
+		if before, after, found := strings.Cut(entry, "="); found {
+			var err error
+			slot, err = strconv.Atoi(before)
+			if err != nil {
+				return nil, fmt.Errorf("bad slot in %q: %w", entry, err)
+			}
+			value = after
+		}
+		if slot < 1 || slot > nPlayers {
+			return nil, fmt.Errorf("%q is for slot %d but the world has "+
+				"slots 1 to %d", entry, slot, nPlayers)
+		}
+		if _, ok := values[slot]; ok {
+			return nil, fmt.Errorf("slot %d is given twice", slot)
+		}
+		values[slot] = value
 	}
+	return values, nil
+}
+
+func newTimedPlayer(server *WorldServer, slot int, timeout time.Duration,
+	fallback string) *TimedPlayer {
+	var p TimedPlayer
+	p.Player = server.Player(slot)
+	p.Name = fmt.Sprintf("player %d", slot)
+	p.Timeout = timeout
+	var err error
+	p.Fallback, err = ParseFallbackPolicy(fallback)
+	Check(err)
+	if p.Fallback == FallbackAI {
+		var ai PlayerAI
+		ai.PlayerIdx = slot - 1
+		ai.Initialize()
+		p.AI = &ai
+	}
+	return &p
+}
+
+func newValidatedPlayer(player PlayerProxy, slot int, hostSlot int,
+	rules InputRules) *ValidatedPlayer {
+	var p ValidatedPlayer
+	p.Player = player
+	p.Name = fmt.Sprintf("player %d", slot)
+	p.Slot = slot
+	p.Rules = rules
+	p.Rules.Host = slot == hostSlot
+	return &p
 }
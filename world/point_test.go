@@ -72,7 +72,7 @@ func TestPt_AddLen_ErrorTolerance(t *testing.T) {
 		var diffs []float64
 		for x := 10; x < 100; x++ {
 			for y := 10; y < 100; y++ {
-				diff := AddLenGetDif(Pt{I(int64(x)), I(int64(y))}, extraLen)
+				diff := AddLenGetDif(Pt{I(x), I(y)}, extraLen)
 				diffs = append(diffs, diff)
 			}
 		}
@@ -87,7 +87,7 @@ func TestPt_AddLen_ErrorTolerance(t *testing.T) {
 		var diffs []float64
 		for x := 100; x < 1000; x++ {
 			for y := 100; y < 1000; y++ {
-				diff := AddLenGetDif(Pt{I(int64(x)), I(int64(y))}, extraLen)
+				diff := AddLenGetDif(Pt{I(x), I(y)}, extraLen)
 				diffs = append(diffs, diff)
 			}
 		}
@@ -180,7 +180,7 @@ func TestPt_SetLen(t *testing.T) {
 	// That requires computing the squared length, which means we must be
 	// under sqrt(MaxInt64) otherwise we will get an overflow when trying
 	// to compute the final actual length.
-	targetLen := I(int64(math.Sqrt(float64(math.MaxInt64)) / 10))
+	targetLen := I64(int64(math.Sqrt(float64(math.MaxInt64)) / 10))
 
 	// Get maximum error for setting the length of vectors with coordinates
 	// between 10 and 100 (exhaustive search).
@@ -188,7 +188,7 @@ func TestPt_SetLen(t *testing.T) {
 		var diffs []float64
 		for x := 10; x < 100; x++ {
 			for y := 10; y < 100; y++ {
-				diff := SetLenGetDif(Pt{I(int64(x)), I(int64(y))}, targetLen)
+				diff := SetLenGetDif(Pt{I(x), I(y)}, targetLen)
 				diffs = append(diffs, diff)
 			}
 		}
@@ -203,7 +203,7 @@ func TestPt_SetLen(t *testing.T) {
 		var diffs []float64
 		for x := 100; x < 1000; x++ {
 			for y := 100; y < 1000; y++ {
-				diff := SetLenGetDif(Pt{I(int64(x)), I(int64(y))}, targetLen)
+				diff := SetLenGetDif(Pt{I(x), I(y)}, targetLen)
 				diffs = append(diffs, diff)
 			}
 		}
@@ -0,0 +1,357 @@
+package world
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// A recording is everything needed to replay a playthrough exactly as it
+// happened, even after the world configuration on disk has changed.
+//
+// On disk, a recording is:
+// - the magic string "BKKREC"
+// - the version of the format, as an int64
+// - a deflate stream containing a sequence of chunks
+//
+// Each chunk is an int64 kind, an int64 payload length and the payload.
+// The chunks are:
+// - header: JSON with the seed and the identity of the AI
+// - config: JSON with a WorldConfig and the frame at which it was loaded
+// - frame: the Input of the players for one frame, followed by the checksum
+// of the world after the frame was simulated
+// - state: a saved state that was loaded before a frame was simulated, as
+// the frame index followed by the state
+// - trailer: the number of frames, written when the recording is closed
+// States and configs are stored right before the frame at which they were
+// loaded.
+// Unknown chunks are skipped, so that older code can still read the parts
+// it understands.
+//
+// The chunks are appended while the playthrough happens (see RecordingWriter).
+// A recording without a trailer was not closed properly, for example because
+// the process died. It is still readable, up to the last chunk that made it
+// to the disk.
+//
+// Recordings made before this format existed are zip files containing only
+// the inputs of Player1. They are read as version 0.
+type Recording struct {
+	Version    int64
+	Seed       int64
+	AIIdentity string
+	Configs    []RecordedConfig
+	States     []RecordedState
+	Inputs     []Input
+	Checksums  []uint64
+}
+
+type RecordedConfig struct {
+	// The frame during which the config was loaded, or InitialConfigFrame for
+	// the config loaded when the world was initialized.
+	FrameIdx int64
+	Config   WorldConfig
+}
+
+// RecordedState is a saved state that replaced the world (and the AI) right
+// before frame FrameIdx was simulated. The world package doesn't know what's
+// inside a saved state, that's up to whoever saved it.
+type RecordedState struct {
+	FrameIdx int64
+	State    []byte
+}
+
+// Version 1 added the recording format.
+// Version 2 added the trailer.
+// Version 3 added states.
+// Version 4 has any number of players. Before, frames had the inputs of
+// exactly two players and the worlds in states had exactly two players.
+const RecordingVersion = 4
+
+const InitialConfigFrame = -1
+
+const recordingMagic = "BKKREC"
+
+const (
+	chunkHeader int64 = iota + 1
+	chunkConfig
+	chunkFrame
+	chunkTrailer
+	chunkState
+)
+
+// How many frames are written to a recording between two flushes. Everything
+// before the last flush survives if the process dies.
+const recordingFlushInterval = 60
+
+type recordingHeader struct {
+	Seed       int64
+	AIIdentity string
+}
+
+// GetConfig returns the config that was loaded during frameIdx, if the world
+// was reloaded during that frame.
+func (r *Recording) GetConfig(frameIdx int64) (c WorldConfig, ok bool) {
+	for i := range r.Configs {
+		if r.Configs[i].FrameIdx == frameIdx {
+			return r.Configs[i].Config, true
+		}
+	}
+	return
+}
+
+// GetState returns the state that was loaded right before frameIdx was
+// simulated, if there is one.
+func (r *Recording) GetState(frameIdx int64) (state []byte, ok bool) {
+	for i := range r.States {
+		if r.States[i].FrameIdx == frameIdx {
+			return r.States[i].State, true
+		}
+	}
+	return
+}
+
+// HasPlayer2Inputs tells if the recording contains what the players after
+// the first one did. Old recordings only contain the inputs of the first
+// player, the others have to be re-simulated by the AI.
+func (r *Recording) HasPlayer2Inputs() bool {
+	return r.Version >= 1
+}
+
+// HasLegacyWorlds tells if the worlds in the states of the recording are
+// the worlds of two players, see World.DeserializeLegacy.
+func (r *Recording) HasLegacyWorlds() bool {
+	return r.Version < 4
+}
+
+// RecordingWriter appends to a recording file as the playthrough happens,
+// instead of rewriting the whole file at every frame.
+type RecordingWriter struct {
+	file             *os.File
+	fw               *flate.Writer
+	nFrames          int64
+	nUnflushedFrames int
+}
+
+func (rw *RecordingWriter) Initialize(filename string, seed int64, aiIdentity string) {
+	var err error
+	rw.file, err = os.Create(filename)
+	Check(err)
+	rw.nFrames = 0
+	rw.nUnflushedFrames = 0
+
+	_, err = rw.file.WriteString(recordingMagic)
+	Check(err)
+	Serialize(rw.file, int64(RecordingVersion))
+
+	rw.fw, err = flate.NewWriter(rw.file, flate.BestSpeed)
+	Check(err)
+	rw.writeJsonChunk(chunkHeader, recordingHeader{seed, aiIdentity})
+	rw.Flush()
+}
+
+func (rw *RecordingWriter) WriteConfig(c RecordedConfig) {
+	rw.writeJsonChunk(chunkConfig, c)
+	// Configs are rare and large, don't risk losing them.
+	rw.Flush()
+}
+
+func (rw *RecordingWriter) WriteState(s RecordedState) {
+	buf := new(bytes.Buffer)
+	Serialize(buf, s.FrameIdx)
+	buf.Write(s.State)
+	rw.writeChunk(chunkState, buf.Bytes())
+	// States are rare and large, don't risk losing them.
+	rw.Flush()
+}
+
+func (rw *RecordingWriter) WriteFrame(input Input, checksum uint64) {
+	buf := new(bytes.Buffer)
+	SerializeSlice(buf, input.Players)
+	Serialize(buf, checksum)
+	rw.writeChunk(chunkFrame, buf.Bytes())
+
+	rw.nFrames++
+	rw.nUnflushedFrames++
+	if rw.nUnflushedFrames >= recordingFlushInterval {
+		rw.Flush()
+	}
+}
+
+// Flush makes sure everything written so far is readable from the file,
+// even if the process dies afterwards.
+// There's no need to sync the file to the disk, as the OS keeps the data
+// even if our process dies.
+func (rw *RecordingWriter) Flush() {
+	err := rw.fw.Flush()
+	Check(err)
+	rw.nUnflushedFrames = 0
+}
+
+// Close writes the trailer, which marks the recording as complete, and
+// closes the file.
+func (rw *RecordingWriter) Close() {
+	buf := new(bytes.Buffer)
+	Serialize(buf, rw.nFrames)
+	rw.writeChunk(chunkTrailer, buf.Bytes())
+
+	err := rw.fw.Close()
+	Check(err)
+	err = rw.file.Close()
+	Check(err)
+	rw.file = nil
+	rw.fw = nil
+}
+
+func (rw *RecordingWriter) IsOpen() bool {
+	return rw.file != nil
+}
+
+func (rw *RecordingWriter) writeChunk(kind int64, payload []byte) {
+	Serialize(rw.fw, kind)
+	Serialize(rw.fw, int64(len(payload)))
+	_, err := rw.fw.Write(payload)
+	Check(err)
+}
+
+func (rw *RecordingWriter) writeJsonChunk(kind int64, v any) {
+	payload, err := json.Marshal(v)
+	Check(err)
+	rw.writeChunk(kind, payload)
+}
+
+// SerializeRecording writes a whole recording at once.
+func SerializeRecording(r *Recording, filename string) {
+	if len(r.Checksums) != len(r.Inputs) {
+		Check(fmt.Errorf("recording has %d inputs but %d checksums",
+			len(r.Inputs), len(r.Checksums)))
+	}
+
+	var rw RecordingWriter
+	rw.Initialize(filename, r.Seed, r.AIIdentity)
+	configIdx := 0
+	stateIdx := 0
+	for frameIdx := range r.Inputs {
+		// Write the states and configs loaded up to and including this frame.
+		for ; stateIdx < len(r.States) &&
+			r.States[stateIdx].FrameIdx <= int64(frameIdx); stateIdx++ {
+			rw.WriteState(r.States[stateIdx])
+		}
+		for ; configIdx < len(r.Configs) &&
+			r.Configs[configIdx].FrameIdx <= int64(frameIdx); configIdx++ {
+			rw.WriteConfig(r.Configs[configIdx])
+		}
+		rw.WriteFrame(r.Inputs[frameIdx], r.Checksums[frameIdx])
+	}
+	for ; stateIdx < len(r.States); stateIdx++ {
+		rw.WriteState(r.States[stateIdx])
+	}
+	for ; configIdx < len(r.Configs); configIdx++ {
+		rw.WriteConfig(r.Configs[configIdx])
+	}
+	rw.Close()
+}
+
+func DeserializeRecording(filename string) *Recording {
+	data := ReadFile(filename)
+
+	// Zip files start with "PK".
+	if bytes.HasPrefix(data, []byte("PK")) {
+		return deserializeLegacyRecording(filename)
+	}
+
+	if !bytes.HasPrefix(data, []byte(recordingMagic)) {
+		Check(fmt.Errorf("%s is not a recording", filename))
+	}
+
+	r := &Recording{}
+	buf := bytes.NewBuffer(data[len(recordingMagic):])
+	Deserialize(buf, &r.Version)
+	if r.Version > RecordingVersion {
+		Check(fmt.Errorf("%s has version %d but only versions up to %d are "+
+			"supported", filename, r.Version, RecordingVersion))
+	}
+
+	fr := flate.NewReader(buf)
+	defer fr.Close()
+	complete := false
+	for !complete {
+		var chunkInfo [2]int64
+		err := binary.Read(fr, binary.LittleEndian, &chunkInfo)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break // Recording was cut short, keep what we have.
+		}
+		Check(err)
+		kind, payloadLen := chunkInfo[0], chunkInfo[1]
+
+		payload := make([]byte, payloadLen)
+		_, err = io.ReadFull(fr, payload)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break // Recording was cut short, keep what we have.
+		}
+		Check(err)
+
+		switch kind {
+		case chunkHeader:
+			var h recordingHeader
+			err = json.Unmarshal(payload, &h)
+			Check(err)
+			r.Seed = h.Seed
+			r.AIIdentity = h.AIIdentity
+		case chunkConfig:
+			var c RecordedConfig
+			err = json.Unmarshal(payload, &c)
+			Check(err)
+			r.Configs = append(r.Configs, c)
+		case chunkFrame:
+			var input Input
+			var checksum uint64
+			payloadBuf := bytes.NewBuffer(payload)
+			if r.Version >= 4 {
+				DeserializeSlice(payloadBuf, &input.Players)
+			} else {
+				input.Players = make([]PlayerInput, 2)
+				Deserialize(payloadBuf, input.Players)
+			}
+			Deserialize(payloadBuf, &checksum)
+			r.Inputs = append(r.Inputs, input)
+			r.Checksums = append(r.Checksums, checksum)
+		case chunkState:
+			var s RecordedState
+			payloadBuf := bytes.NewBuffer(payload)
+			Deserialize(payloadBuf, &s.FrameIdx)
+			s.State = payloadBuf.Bytes()
+			r.States = append(r.States, s)
+		case chunkTrailer:
+			var nFrames int64
+			Deserialize(bytes.NewBuffer(payload), &nFrames)
+			if nFrames != int64(len(r.Inputs)) {
+				Check(fmt.Errorf("%s should have %d frames but has %d",
+					filename, nFrames, len(r.Inputs)))
+			}
+			complete = true
+		}
+	}
+
+	// Before version 2 there was no trailer.
+	if !complete && r.Version >= 2 {
+		log.Printf("%s is incomplete, recovered %d frames", filename, len(r.Inputs))
+	}
+	return r
+}
+
+func deserializeLegacyRecording(filename string) *Recording {
+	r := &Recording{}
+	r.Version = 0
+	playerInputs := DeserializeInputs(filename)
+	r.Inputs = make([]Input, len(playerInputs))
+	for i := range playerInputs {
+		r.Inputs[i].Players = []PlayerInput{playerInputs[i], {}}
+	}
+	return r
+}
@@ -0,0 +1,113 @@
+package world
+
+import (
+	"bytes"
+	"compress/flate"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	. "playful-patterns.com/bakoko/ints"
+	"testing"
+)
+
+func TestRecording_SerializeDeserialize(t *testing.T) {
+	var r Recording
+	r.Version = RecordingVersion
+	r.Seed = 1234
+	r.AIIdentity = "test AI"
+	r.Configs = []RecordedConfig{
+		{InitialConfigFrame, WorldConfig{"{}", "xxx\nx x\nxxx"}},
+		{1, WorldConfig{"{\"BallSpeed\": 3}", "xxx"}},
+	}
+	r.States = []RecordedState{{2, []byte{1, 2, 3}}}
+	for i := 0; i < 3; i++ {
+		input := Input{Players: make([]PlayerInput, 2)}
+		input.Players[0].MoveLeft = i%2 == 0
+		input.Players[0].ShootPt = Pt{I(i), I(-i)}
+		input.Players[1].Shoot = true
+		r.Inputs = append(r.Inputs, input)
+		r.Checksums = append(r.Checksums, uint64(i*1000))
+	}
+
+	filename := filepath.Join(t.TempDir(), "recording.bkk")
+	SerializeRecording(&r, filename)
+	r2 := DeserializeRecording(filename)
+	assert.Equal(t, r, *r2)
+
+	c, ok := r2.GetConfig(1)
+	assert.True(t, ok)
+	assert.Equal(t, "xxx", c.Level)
+	_, ok = r2.GetConfig(2)
+	assert.False(t, ok)
+
+	s, ok := r2.GetState(2)
+	assert.True(t, ok)
+	assert.Equal(t, []byte{1, 2, 3}, s)
+}
+
+func TestRecording_DeserializeLegacy(t *testing.T) {
+	inputs := []PlayerInput{{MoveUp: true}, {Shoot: true, ShootPt: IPt(3, 4)}}
+	filename := filepath.Join(t.TempDir(), "recording.bkk")
+	SerializeInputs(inputs, filename)
+
+	r := DeserializeRecording(filename)
+	assert.Equal(t, int64(0), r.Version)
+	assert.Equal(t, 2, len(r.Inputs))
+	assert.Equal(t, inputs[0], r.Inputs[0].Player(0))
+	assert.Equal(t, inputs[1], r.Inputs[1].Player(0))
+	assert.Equal(t, PlayerInput{}, r.Inputs[1].Player(1))
+}
+
+func TestRecordingWriter_RecoverWithoutTrailer(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "recording.bkk")
+	var rw RecordingWriter
+	rw.Initialize(filename, 5, "test AI")
+	rw.WriteConfig(RecordedConfig{InitialConfigFrame, WorldConfig{"{}", "x"}})
+	nFrames := recordingFlushInterval*2 + 10
+	for i := 0; i < nFrames; i++ {
+		input := Input{Players: make([]PlayerInput, 2)}
+		input.Players[0].ShootPt = IPt(i, i)
+		rw.WriteFrame(input, uint64(i))
+	}
+
+	// Simulate the process dying: the file is never closed, so the frames
+	// after the last flush are lost but everything before is readable.
+	r := DeserializeRecording(filename)
+	assert.Equal(t, int64(5), r.Seed)
+	assert.Equal(t, 1, len(r.Configs))
+	assert.Equal(t, recordingFlushInterval*2, len(r.Inputs))
+	assert.Equal(t, IPt(7, 7), r.Inputs[7].Player(0).ShootPt)
+	assert.Equal(t, uint64(7), r.Checksums[7])
+
+	// Closing writes the rest and the trailer.
+	rw.Close()
+	r = DeserializeRecording(filename)
+	assert.Equal(t, nFrames, len(r.Inputs))
+}
+
+// Before version 4, frames had the inputs of exactly two players.
+func TestRecording_DeserializeVersion3(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "recording.bkk")
+	var rw RecordingWriter
+	var err error
+	rw.file, err = os.Create(filename)
+	assert.Nil(t, err)
+	_, err = rw.file.WriteString(recordingMagic)
+	assert.Nil(t, err)
+	Serialize(rw.file, int64(3))
+	rw.fw, err = flate.NewWriter(rw.file, flate.BestSpeed)
+	assert.Nil(t, err)
+	inputs := []PlayerInput{{MoveUp: true}, {Shoot: true, ShootPt: IPt(3, 4)}}
+	payload := new(bytes.Buffer)
+	Serialize(payload, inputs)
+	Serialize(payload, uint64(7))
+	rw.writeChunk(chunkFrame, payload.Bytes())
+	rw.nFrames = 1
+	rw.Close()
+
+	r := DeserializeRecording(filename)
+	assert.Equal(t, int64(3), r.Version)
+	assert.Equal(t, []Input{{Players: inputs}}, r.Inputs)
+	assert.Equal(t, []uint64{7}, r.Checksums)
+	assert.True(t, r.HasLegacyWorlds())
+}
@@ -1,95 +1,144 @@
 package world
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"net"
-	. "playful-patterns.com/bakoko/ints"
+	"syscall"
 	"time"
 )
 
-func ReadData(conn net.Conn, timeout time.Duration) ([]byte, error) {
-	// Create a buffer to read data into.
-	buffer := make([]byte, 1024)
-	// Create the slice where we'll keep our full message.
-	var fullMessage []byte
-	// Expected length == 0 means we don't know the expected length yet.
-	expectedLen := I(0)
-
-	for {
-		// Set deadline only for this operation.
-		if timeout.Milliseconds() > 0 {
-			err := conn.SetDeadline(time.Now().Add(timeout))
-			if err != nil {
-				return fullMessage, err
-			}
-		}
+// TcpTransport sends messages over TCP/IP, with a codec that says where a
+// message ends.
+type TcpTransport struct {
+	// nil means LengthPrefixCodec with the default limits.
+	Codec Codec
+}
 
-		// Read (some) data from the client.
-		nBytesAcuallyReceived, err := conn.Read(buffer)
+func (t *TcpTransport) codec() Codec {
+	if t.Codec == nil {
+		return &LengthPrefixCodec{}
+	}
+	return t.Codec
+}
 
-		// Reset the deadline because otherwise it will apply to future operations as well.
-		conn.SetDeadline(time.Time{})
+func (t *TcpTransport) Listen(endpoint string) (Listener, error) {
+	listener, err := net.Listen("tcp", endpoint)
+	if err != nil {
+		return nil, &TransportError{"listen", endpoint, tcpError(err)}
+	}
+	return &tcpListener{listener, t.codec()}, nil
+}
 
-		if err != nil {
-			return fullMessage, err
-		}
+func (t *TcpTransport) Dial(endpoint string, timeout time.Duration) (Conn, error) {
+	conn, err := net.DialTimeout("tcp", endpoint, timeout)
+	if err != nil {
+		return nil, &TransportError{"dial", endpoint, tcpError(err)}
+	}
+	return NewTcpConn(conn, t.codec()), nil
+}
 
-		// Append whatever data we got to our full message.
-		fullMessage = append(fullMessage, buffer[:nBytesAcuallyReceived]...)
+type tcpListener struct {
+	listener net.Listener
+	codec    Codec
+}
 
-		// Get the expected length (if possible).
-		// The first int64 indicates the length of the rest of the message.
-		// Check if we got at least an int64.
-		if expectedLen.Eq(I(0)) && len(fullMessage) >= 8 {
-			// Yes, we have it, now we can extract the expected length.
-			Deserialize(bytes.NewBuffer(fullMessage), &expectedLen)
-		}
+func (l *tcpListener) Accept() (Conn, error) {
+	conn, err := l.listener.Accept()
+	if err != nil {
+		return nil, &TransportError{"accept", l.Addr(), tcpError(err)}
+	}
+	return NewTcpConn(conn, l.codec), nil
+}
 
-		// Check if we got the expected number of bytes or not.
-		if I(len(fullMessage)).Eq(expectedLen) {
-			return fullMessage[8:], nil // Skip the length from the gui-data.
-		}
-		if I(len(fullMessage)).Gt(expectedLen) {
-			return fullMessage, errors.New(fmt.Sprintf("got more than the "+
-				"expected number of bytes - something in the communication "+
-				"protocol is off - expected %d received %d",
-				expectedLen, len(fullMessage)))
-		}
+func (l *tcpListener) Close() error {
+	return l.listener.Close()
+}
 
-		if I(len(fullMessage)).Geq(expectedLen) {
-			return fullMessage[8:], nil // Skip the length from the gui-data.
-		}
-	}
+func (l *tcpListener) Addr() string {
+	return l.listener.Addr().String()
 }
 
-func WriteData(conn net.Conn, data []byte, timeout time.Duration) error {
-	// Docs for the io.Writer interface says that if the entire data hasn't
-	// been written then err will be non-nil.
+type tcpConn struct {
+	conn  net.Conn
+	codec Codec
+}
 
-	// Write the total length of the data first.
-	buf := new(bytes.Buffer)
-	dataLen := int64(len(data) + 8) // include the dataLen field in the total length
-	Serialize(buf, dataLen)
+// NewTcpConn makes a Conn out of a connection that is already open.
+func NewTcpConn(conn net.Conn, codec Codec) Conn {
+	return &tcpConn{conn, codec}
+}
 
+func (c *tcpConn) ReadMessage(timeout time.Duration) ([]byte, error) {
 	// Set deadline only for this operation.
 	if timeout.Milliseconds() > 0 {
-		err := conn.SetDeadline(time.Now().Add(timeout))
-		if err != nil {
-			return err
+		if err := c.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, &TransportError{"read", "", tcpError(err)}
 		}
+		// Reset the deadline because otherwise it will apply to future
+		// operations as well.
+		defer c.conn.SetDeadline(time.Time{})
 	}
-	_, err := conn.Write(buf.Bytes())
-
-	// Reset the deadline because otherwise it will apply to future operations as well.
-	conn.SetDeadline(time.Time{})
 
+	data, err := c.codec.ReadMessage(c.conn)
 	if err != nil {
-		return err
+		return nil, &TransportError{"read", "", tcpError(err)}
+	}
+	return data, nil
+}
+
+func (c *tcpConn) WriteMessage(data []byte, timeout time.Duration) error {
+	// Set deadline only for this operation.
+	if timeout.Milliseconds() > 0 {
+		if err := c.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return &TransportError{"write", "", tcpError(err)}
+		}
+		// Reset the deadline because otherwise it will apply to future
+		// operations as well.
+		defer c.conn.SetDeadline(time.Time{})
 	}
 
-	// Write the data itself.
-	_, err = conn.Write(data)
+	if err := c.codec.WriteMessage(c.conn, data); err != nil {
+		return &TransportError{"write", "", tcpError(err)}
+	}
+	return nil
+}
+
+func (c *tcpConn) Close() error {
+	return c.conn.Close()
+}
+
+// Translate the errors of the net package to our errors, so that the callers
+// don't have to know what is under the transport. The original error is kept
+// as well.
+func tcpError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	// A connection cut in the middle of a message is closed as well.
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) {
+		return fmt.Errorf("%w: %w", ErrClosed, err)
+	}
+	// Windows has its own code for an address that is taken,
+	// WSAEADDRINUSE.
+	if errors.Is(err, syscall.EADDRINUSE) ||
+		errors.Is(err, syscall.Errno(10048)) {
+		return fmt.Errorf("%w: %w", ErrEndpointInUse, err)
+	}
 	return err
 }
+
+// ReadData reads one message from a TCP/IP connection, with the default
+// codec.
+func ReadData(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	return NewTcpConn(conn, &LengthPrefixCodec{}).ReadMessage(timeout)
+}
+
+// WriteData writes one message to a TCP/IP connection, with the default
+// codec.
+func WriteData(conn net.Conn, data []byte, timeout time.Duration) error {
+	return NewTcpConn(conn, &LengthPrefixCodec{}).WriteMessage(data, timeout)
+}
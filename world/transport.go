@@ -0,0 +1,204 @@
+package world
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// The modules (world, gui, AI) send messages to each other. A message is
+// just a slice of bytes, the modules decide what it means. How the bytes get
+// to the other side is the business of a Transport. This way the proxies
+// don't care if they talk over TCP/IP or over channels in the same process
+// (which is what we want for tests).
+
+// Transport opens connections that carry whole messages.
+type Transport interface {
+	// Listen starts waiting for connections at the endpoint.
+	Listen(endpoint string) (Listener, error)
+	// Dial connects to someone listening at the endpoint. A timeout of 0
+	// means no timeout.
+	Dial(endpoint string, timeout time.Duration) (Conn, error)
+}
+
+type Listener interface {
+	// Accept blocks until someone connects.
+	Accept() (Conn, error)
+	Close() error
+	// Addr is the endpoint the listener actually listens at. It is useful
+	// when listening at port 0 and letting the OS pick the port.
+	Addr() string
+}
+
+// Conn is a connection that carries whole messages. A timeout of 0 means
+// no timeout.
+type Conn interface {
+	ReadMessage(timeout time.Duration) ([]byte, error)
+	WriteMessage(data []byte, timeout time.Duration) error
+	Close() error
+}
+
+// The reasons for which a transport operation fails. Check them with
+// errors.Is, the actual error is a *TransportError which also has the
+// original error, if there is one.
+var (
+	ErrTimeout          = errors.New("timeout")
+	ErrClosed           = errors.New("connection closed")
+	ErrNoConnection     = errors.New("no connection")
+	ErrMessageTooLarge  = errors.New("message too large")
+	ErrMalformedMessage = errors.New("malformed message")
+	ErrEndpointInUse    = errors.New("endpoint already in use")
+)
+
+// TransportError says which operation failed and why.
+type TransportError struct {
+	Op       string // listen, accept, dial, read or write
+	Endpoint string
+	Err      error
+}
+
+func (e *TransportError) Error() string {
+	if e.Endpoint == "" {
+		return fmt.Sprintf("%s: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Endpoint, e.Err)
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// DefaultMaxMessageSize is used when a codec or transport doesn't set its
+// own limit. It is way more than a world or some debug info needs, but it
+// stops a broken or malicious peer from making us allocate gigabytes.
+const DefaultMaxMessageSize = 16 * 1024 * 1024
+
+func maxMessageSize(max int64) int64 {
+	if max <= 0 {
+		return DefaultMaxMessageSize
+	}
+	return max
+}
+
+// Codec splits a stream of bytes into messages.
+type Codec interface {
+	WriteMessage(w io.Writer, data []byte) error
+	ReadMessage(r io.Reader) ([]byte, error)
+}
+
+// LengthPrefixCodec puts an int64 in front of each message. The int64 is the
+// length of the whole message, including the int64 itself.
+type LengthPrefixCodec struct {
+	// Messages bigger than this are refused. 0 means DefaultMaxMessageSize.
+	MaxMessageSize int64
+}
+
+const lengthPrefixSize = 8
+
+func (c *LengthPrefixCodec) WriteMessage(w io.Writer, data []byte) error {
+	if int64(len(data)) > maxMessageSize(c.MaxMessageSize) {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrMessageTooLarge,
+			len(data), maxMessageSize(c.MaxMessageSize))
+	}
+
+	// Write the length and the data in one go, so that the peer doesn't get
+	// the length without the data if we fail halfway.
+	// Docs for the io.Writer interface says that if the entire data hasn't
+	// been written then err will be non-nil.
+	buf := new(bytes.Buffer)
+	Serialize(buf, int64(len(data)+lengthPrefixSize))
+	buf.Write(data)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (c *LengthPrefixCodec) ReadMessage(r io.Reader) ([]byte, error) {
+	prefix := make([]byte, lengthPrefixSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, err
+	}
+
+	var totalLen int64
+	Deserialize(bytes.NewBuffer(prefix), &totalLen)
+	dataLen := totalLen - lengthPrefixSize
+	if dataLen < 0 {
+		return nil, fmt.Errorf("%w: the length %d is less than the length "+
+			"of the prefix - something in the communication protocol is off",
+			ErrMalformedMessage, totalLen)
+	}
+	if dataLen > maxMessageSize(c.MaxMessageSize) {
+		return nil, fmt.Errorf("%w: %d bytes, the limit is %d",
+			ErrMessageTooLarge, dataLen, maxMessageSize(c.MaxMessageSize))
+	}
+
+	data := make([]byte, dataLen)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if errors.Is(err, io.EOF) {
+			// We got the length, so the message was cut short.
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// LineCodec ends each message with a newline, so the messages themselves
+// must not contain newlines. It is meant for peers that send text, like
+// scripts that talk JSON, for which a binary length is a bother.
+type LineCodec struct {
+	// Messages bigger than this are refused. 0 means DefaultMaxMessageSize.
+	MaxMessageSize int64
+}
+
+func (c *LineCodec) WriteMessage(w io.Writer, data []byte) error {
+	if int64(len(data)) > maxMessageSize(c.MaxMessageSize) {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrMessageTooLarge,
+			len(data), maxMessageSize(c.MaxMessageSize))
+	}
+	if bytes.IndexByte(data, '\n') >= 0 {
+		return fmt.Errorf("%w: the message contains a newline",
+			ErrMalformedMessage)
+	}
+
+	// Write the data and the newline in one go, like LengthPrefixCodec.
+	buf := make([]byte, 0, len(data)+1)
+	buf = append(buf, data...)
+	buf = append(buf, '\n')
+	_, err := w.Write(buf)
+	return err
+}
+
+// The codec is shared by all the connections of a listener, so it can't
+// keep what it read past the newline for the next message. It reads one
+// byte at a time instead, which is slow, but the messages that come this way
+// are small.
+func (c *LineCodec) ReadMessage(r io.Reader) ([]byte, error) {
+	var data []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			if errors.Is(err, io.EOF) && len(data) > 0 {
+				// We got part of a line, so the message was cut short.
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		if int64(len(data)) >= maxMessageSize(c.MaxMessageSize) {
+			return nil, fmt.Errorf("%w: more than %d bytes without a newline",
+				ErrMessageTooLarge, maxMessageSize(c.MaxMessageSize))
+		}
+		data = append(data, b[0])
+	}
+
+	// Scripts on Windows may end their lines with \r\n.
+	data = bytes.TrimSuffix(data, []byte{'\r'})
+	if data == nil {
+		data = []byte{}
+	}
+	return data, nil
+}
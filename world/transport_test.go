@@ -0,0 +1,157 @@
+package world
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestLengthPrefixCodec(t *testing.T) {
+	codec := LengthPrefixCodec{MaxMessageSize: 10}
+	var stream bytes.Buffer
+
+	// Messages come out whole and in order.
+	assert.Nil(t, codec.WriteMessage(&stream, []byte{1, 2, 3}))
+	assert.Nil(t, codec.WriteMessage(&stream, []byte{}))
+	assert.Equal(t, 8+3+8, stream.Len())
+	data, err := codec.ReadMessage(&stream)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1, 2, 3}, data)
+	data, err = codec.ReadMessage(&stream)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{}, data)
+
+	// Too large, both ways.
+	err = codec.WriteMessage(&stream, make([]byte, 11))
+	assert.ErrorIs(t, err, ErrMessageTooLarge)
+	assert.Equal(t, 0, stream.Len())
+	Serialize(&stream, int64(8+11))
+	_, err = codec.ReadMessage(&stream)
+	assert.ErrorIs(t, err, ErrMessageTooLarge)
+
+	// A length that can't be right.
+	stream.Reset()
+	Serialize(&stream, int64(3))
+	_, err = codec.ReadMessage(&stream)
+	assert.ErrorIs(t, err, ErrMalformedMessage)
+}
+
+func TestLineCodec(t *testing.T) {
+	codec := LineCodec{MaxMessageSize: 10}
+	var stream bytes.Buffer
+
+	// Messages come out whole and in order.
+	assert.Nil(t, codec.WriteMessage(&stream, []byte("{}")))
+	assert.Nil(t, codec.WriteMessage(&stream, []byte{}))
+	assert.Equal(t, "{}\n\n", stream.String())
+	stream.WriteString("[1]\r\n")
+	for _, expected := range []string{"{}", "", "[1]"} {
+		data, err := codec.ReadMessage(&stream)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(expected), data)
+	}
+
+	// A message can't have a newline in it.
+	err := codec.WriteMessage(&stream, []byte("{\n}"))
+	assert.ErrorIs(t, err, ErrMalformedMessage)
+
+	// Too large, both ways.
+	err = codec.WriteMessage(&stream, make([]byte, 11))
+	assert.ErrorIs(t, err, ErrMessageTooLarge)
+	assert.Equal(t, 0, stream.Len())
+	stream.WriteString("12345678901\n")
+	_, err = codec.ReadMessage(&stream)
+	assert.ErrorIs(t, err, ErrMessageTooLarge)
+
+	// Cut short.
+	stream.Reset()
+	stream.WriteString("{")
+	_, err = codec.ReadMessage(&stream)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
+
+func testTransport(t *testing.T, transport Transport, endpoint string) {
+	listener, err := transport.Listen(endpoint)
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	accepted := make(chan Conn)
+	go func() {
+		conn, err := listener.Accept()
+		assert.Nil(t, err)
+		accepted <- conn
+	}()
+	client, err := transport.Dial(listener.Addr(), time.Second)
+	assert.Nil(t, err)
+	server := <-accepted
+
+	// Messages go both ways.
+	assert.Nil(t, client.WriteMessage([]byte("hello"), time.Second))
+	data, err := server.ReadMessage(time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), data)
+	assert.Nil(t, server.WriteMessage([]byte("world"), time.Second))
+	data, err = client.ReadMessage(time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("world"), data)
+
+	// Nobody writes, so reading times out.
+	_, err = server.ReadMessage(10 * time.Millisecond)
+	assert.ErrorIs(t, err, ErrTimeout)
+	var transportErr *TransportError
+	assert.ErrorAs(t, err, &transportErr)
+	assert.Equal(t, "read", transportErr.Op)
+
+	// The peer is gone.
+	client.Close()
+	_, err = server.ReadMessage(time.Second)
+	assert.ErrorIs(t, err, ErrClosed)
+	server.Close()
+}
+
+func TestTcpTransport(t *testing.T) {
+	testTransport(t, &TcpTransport{}, "localhost:0")
+	testTransport(t, &TcpTransport{Codec: &LineCodec{}}, "localhost:0")
+
+	// Like for the other transports, an endpoint can only be listened on
+	// once.
+	var transport TcpTransport
+	listener, err := transport.Listen("localhost:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	_, err = transport.Listen(listener.Addr())
+	assert.ErrorIs(t, err, ErrEndpointInUse)
+}
+
+func TestMemoryTransport(t *testing.T) {
+	var transport MemoryTransport
+	testTransport(t, &transport, "test")
+
+	// Nobody listens.
+	_, err := transport.Dial("test", time.Second)
+	assert.ErrorIs(t, err, ErrNoConnection)
+
+	// Only one listener per endpoint.
+	listener, err := transport.Listen("test")
+	assert.Nil(t, err)
+	_, err = transport.Listen("test")
+	assert.ErrorIs(t, err, ErrEndpointInUse)
+
+	// Nobody accepts.
+	_, err = transport.Dial("test", 10*time.Millisecond)
+	assert.ErrorIs(t, err, ErrTimeout)
+	listener.Close()
+
+	// Too large.
+	transport.MaxMessageSize = 2
+	listener, err = transport.Listen("test")
+	assert.Nil(t, err)
+	go listener.Accept()
+	client, err := transport.Dial("test", time.Second)
+	assert.Nil(t, err)
+	err = client.WriteMessage([]byte{1, 2, 3}, time.Second)
+	assert.ErrorIs(t, err, ErrMessageTooLarge)
+	listener.Close()
+}
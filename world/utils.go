@@ -11,6 +11,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"runtime/debug"
 	"time"
 )
 
@@ -116,10 +117,70 @@ func SerializeSlice[T any](buf *bytes.Buffer, s []T) {
 }
 
 func DeserializeSlice[T any](buf *bytes.Buffer, s *[]T) {
-	var lenSlice int64
-	Deserialize(buf, &lenSlice)
+	r := Reader{Buf: buf}
+	ReadSlice(&r, s)
+	Check(r.Err)
+}
+
+// Reader reads what Serialize and SerializeSlice wrote, like Deserialize
+// and DeserializeSlice, but for data that comes from someone else, like a
+// peer on the network. Such data may be short or garbage, and that must not
+// crash us. So instead of panicking, the Reader keeps the first error and
+// doesn't read anything after it. The caller checks Err once it read
+// everything.
+type Reader struct {
+	Buf *bytes.Buffer
+	Err error
+}
+
+func (r *Reader) Read(data any) {
+	if r.Err != nil {
+		return
+	}
+	if err := binary.Read(r.Buf, binary.LittleEndian, data); err != nil {
+		r.Err = fmt.Errorf("%w: %w", ErrMalformedMessage, err)
+	}
+}
+
+// ReadLen reads the length of something that has elemSize bytes for each
+// element. A length that the rest of the data can't hold is an error, so
+// that a bad length doesn't make us allocate gigabytes.
+func (r *Reader) ReadLen(elemSize int) int64 {
+	var n int64
+	r.Read(&n)
+	if !r.Fits(n, elemSize) {
+		return 0
+	}
+	return n
+}
+
+// Fits tells if the rest of the data can hold n elements of elemSize bytes.
+// If it can't, the Reader fails.
+func (r *Reader) Fits(n int64, elemSize int) bool {
+	if r.Err != nil {
+		return false
+	}
+	if n < 0 || elemSize > 0 && n > int64(r.Buf.Len()/elemSize) {
+		r.Err = fmt.Errorf("%w: %d elements of %d bytes don't fit in the "+
+			"remaining %d bytes", ErrMalformedMessage, n, elemSize,
+			r.Buf.Len())
+		return false
+	}
+	return true
+}
+
+// ReadSlice is Reader.Read for what SerializeSlice wrote.
+func ReadSlice[T any](r *Reader, s *[]T) {
+	var elem T
+	lenSlice := r.ReadLen(binary.Size(elem))
+	if r.Err != nil || lenSlice == 0 {
+		// Empty slices are nil until something is appended to them, keep it
+		// that way so that deserialized objects equal the serialized ones.
+		*s = nil
+		return
+	}
 	*s = make([]T, lenSlice)
-	Deserialize(buf, *s)
+	r.Read(*s)
 }
 
 type TimedFunction func()
@@ -130,6 +191,15 @@ func Duration(function TimedFunction) float64 {
 	return time.Since(start).Seconds()
 }
 
+// TimeoutChan returns a channel that fires after the timeout, or never if
+// the timeout is 0, for a select that may or may not have a timeout.
+func TimeoutChan(timeout time.Duration) <-chan time.Time {
+	if timeout <= 0 {
+		return nil
+	}
+	return time.After(timeout)
+}
+
 func ReadAllText(filename string) string {
 	file, err := os.Open(filename)
 	Check(err)
@@ -174,6 +244,31 @@ func (f *FolderWatcher) FolderContentsChanged() bool {
 	return changed
 }
 
+// BuildHash identifies the code that the current executable was built from.
+// It is the VCS revision embedded by the Go toolchain, with a "-dirty" suffix
+// if there were uncommitted changes, or "unknown" if there is no revision.
+func BuildHash() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	revision := "unknown"
+	modified := false
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" {
+			revision = s.Value
+		}
+		if s.Key == "vcs.modified" {
+			modified = s.Value == "true"
+		}
+	}
+	if modified {
+		revision += "-dirty"
+	}
+	return revision
+}
+
 func HomeFolder() string {
 	ex, err := os.Executable()
 	Check(err)
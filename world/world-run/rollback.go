@@ -0,0 +1,168 @@
+package world_run
+
+import (
+	"errors"
+	. "playful-patterns.com/bakoko/world"
+)
+
+// RollbackRunner plays against a remote player without waiting for the
+// inputs of the remote player. Until the real input of a frame arrives, it
+// guesses that the remote player keeps doing what it did last and runs the
+// world with the guess. When the real input arrives and the guess was
+// wrong, it goes back to the world before that frame and runs the frames
+// again with the real input.
+// Only the frames for which both inputs are known are given to the
+// WorldRunner, so the runner records (and checksums) the real game, the
+// same game the remote player records.
+type RollbackRunner struct {
+	runner      *WorldRunner
+	localPlayer int // 1 or 2.
+	maxFrames   int
+	// The world we show, which is ahead of the world of the runner by the
+	// frames in history.
+	w World
+	// The frames after the frame of the runner, oldest first.
+	history []rollbackFrame
+	// The last real input of the remote player, to guess the next ones.
+	lastRemote PlayerInput
+	// Real inputs for frames we haven't run yet, because the remote player
+	// is ahead of us.
+	early map[int]PlayerInput
+}
+
+type rollbackFrame struct {
+	before World // The world before the frame.
+	local  PlayerInput
+	remote PlayerInput
+	known  bool // The remote input is the real one, not a guess.
+}
+
+// Initialize starts from the current world of the runner. The runner must
+// be initialized with InitializeLockstep, as the world must be reloaded the
+// same way when the frames are run again. maxFrames is how far ahead of the
+// runner the world may go, which is how far back a rollback may have to go.
+func (r *RollbackRunner) Initialize(runner *WorldRunner, localPlayer int,
+	maxFrames int) {
+	if runner.fixedConfig == nil {
+		Check(errors.New("rollback needs a runner initialized for lockstep"))
+	}
+	r.runner = runner
+	r.localPlayer = localPlayer
+	r.maxFrames = maxFrames
+	r.w = runner.GetWorld().Clone()
+	r.history = nil
+	r.lastRemote = PlayerInput{}
+	r.early = map[int]PlayerInput{}
+}
+
+// GetWorld returns the world to show, which may be based on guesses.
+func (r *RollbackRunner) GetWorld() *World {
+	return &r.w
+}
+
+// GetFrameIdx returns the frame of the world to show.
+func (r *RollbackRunner) GetFrameIdx() int {
+	return r.runner.GetFrameIdx() + len(r.history)
+}
+
+// CanStep says if the world may go further ahead of the inputs of the
+// remote player. If it can't, we must wait for them.
+func (r *RollbackRunner) CanStep() bool {
+	return len(r.history) < r.maxFrames
+}
+
+// Step runs the frame of GetFrameIdx with our input and the input of the
+// remote player, if we have it, or a guess.
+func (r *RollbackRunner) Step(local PlayerInput) {
+	frameIdx := r.GetFrameIdx()
+	f := rollbackFrame{before: r.w.Clone(), local: local}
+	if remote, ok := r.early[frameIdx]; ok {
+		f.remote = remote
+		f.known = true
+		delete(r.early, frameIdx)
+	} else {
+		f.remote = r.guess()
+	}
+	r.history = append(r.history, f)
+	r.step(frameIdx, f)
+	r.confirm()
+}
+
+// SetRemoteInput gives the real input of the remote player for a frame.
+// The inputs should be given in the order of their frames. An input for a
+// frame whose input we already have is late or duplicated, which happens on
+// a real network, and is dropped.
+func (r *RollbackRunner) SetRemoteInput(frameIdx int, remote PlayerInput) {
+	i := frameIdx - r.runner.GetFrameIdx()
+	if i < 0 || i < len(r.history) && r.history[i].known {
+		return
+	}
+	if _, ok := r.early[frameIdx]; ok {
+		return
+	}
+	r.lastRemote = remote
+	if i >= len(r.history) {
+		r.early[frameIdx] = remote
+		return
+	}
+
+	r.history[i].known = true
+	if r.history[i].remote != remote {
+		r.history[i].remote = remote
+		r.rollback(i)
+	}
+	r.confirm()
+}
+
+// The remote player keeps moving like it did, but doesn't repeat actions
+// that happen once per key press.
+func (r *RollbackRunner) guess() PlayerInput {
+	input := r.lastRemote
+	input.Shoot = false
+	input.Reload = false
+	input.Quit = false
+	return input
+}
+
+// Go back to the world before the frame in the history and run the frames
+// again, with new guesses for the frames we don't know yet.
+func (r *RollbackRunner) rollback(i int) {
+	r.w = r.history[i].before.Clone()
+	for j := i; j < len(r.history); j++ {
+		f := &r.history[j]
+		if j > i {
+			f.before = r.w.Clone()
+			if !f.known {
+				f.remote = r.guess()
+			}
+		}
+		r.step(r.runner.GetFrameIdx()+j, *f)
+	}
+}
+
+// Give the runner the frames at the start of the history for which we have
+// both inputs.
+func (r *RollbackRunner) confirm() {
+	for len(r.history) > 0 && r.history[0].known {
+		r.runner.Step(r.inputs(r.history[0]))
+		r.history = r.history[1:]
+	}
+}
+
+func (r *RollbackRunner) inputs(f rollbackFrame) (input Input) {
+	if r.localPlayer == 1 {
+		input.Players = []PlayerInput{f.local, f.remote}
+	} else {
+		input.Players = []PlayerInput{f.remote, f.local}
+	}
+	return
+}
+
+// The runner of a lockstep game only reloads when asked to, and always
+// from the same config.
+func (r *RollbackRunner) step(frameIdx int, f rollbackFrame) {
+	input := r.inputs(f)
+	stepFrame(&r.w, &input, frameIdx, input.Reload(), func() {
+		LoadWorldFromConfig(&r.w, *r.runner.fixedConfig)
+	})
+}
@@ -0,0 +1,131 @@
+package world_run
+
+import (
+	"github.com/stretchr/testify/assert"
+	"playful-patterns.com/bakoko/internal/worldtest"
+	. "playful-patterns.com/bakoko/ints"
+	. "playful-patterns.com/bakoko/world"
+	"testing"
+)
+
+func testWorldConfig() WorldConfig {
+	return WorldConfig{WorldJson: worldtest.WorldJson, Level: worldtest.Level}
+}
+
+func input1(frameIdx int) (input PlayerInput) {
+	input.MoveRight = frameIdx < 50
+	input.MoveDown = frameIdx >= 80 && frameIdx < 120
+	input.Shoot = frameIdx == 60 || frameIdx == 150
+	input.ShootPt = Pt{I(30000), I(10000)}
+	input.Pause = frameIdx >= 200 && frameIdx < 210
+	return
+}
+
+func input2(frameIdx int) (input PlayerInput) {
+	input.MoveDown = frameIdx >= 20 && frameIdx < 100
+	input.MoveLeft = frameIdx >= 100 && frameIdx < 200
+	input.Shoot = frameIdx == 30
+	input.ShootPt = Pt{I(10000), I(10000)}
+	input.Reload = frameIdx == 250
+	return
+}
+
+// Two players in rollback mode, with inputs that take some frames to get to
+// the other player, play the same game as two players who always know each
+// other's inputs.
+func TestRollbackRunner(t *testing.T) {
+	const nFrames = 300
+	const maxFrames = 10
+	c := testWorldConfig()
+	var direct WorldRunner
+	direct.InitializeLockstep("", 42, c)
+	for i := 0; i < nFrames; i++ {
+		direct.Step(Input{Players: []PlayerInput{input1(i), input2(i)}})
+	}
+
+	// The latency is in frames. With more latency than maxFrames, the
+	// players have to wait for each other.
+	for _, latency := range []int{0, 1, 5, 15} {
+		var wr1, wr2 WorldRunner
+		wr1.InitializeLockstep("", 42, c)
+		wr2.InitializeLockstep("", 42, c)
+		var r1, r2 RollbackRunner
+		r1.Initialize(&wr1, 1, maxFrames)
+		r2.Initialize(&wr2, 2, maxFrames)
+
+		type message struct {
+			arrival  int
+			frameIdx int
+			input    PlayerInput
+		}
+		var to1, to2 []message
+		deliver := func(r *RollbackRunner, messages []message,
+			now int) []message {
+			for len(messages) > 0 && messages[0].arrival <= now {
+				r.SetRemoteInput(messages[0].frameIdx, messages[0].input)
+				messages = messages[1:]
+			}
+			return messages
+		}
+		step := func(r *RollbackRunner, input func(int) PlayerInput,
+			messages []message, now int) []message {
+			if r.CanStep() && r.GetFrameIdx() < nFrames {
+				frameIdx := r.GetFrameIdx()
+				messages = append(messages,
+					message{now + latency, frameIdx, input(frameIdx)})
+				r.Step(input(frameIdx))
+			}
+			return messages
+		}
+		for now := 0; wr1.GetFrameIdx() < nFrames ||
+			wr2.GetFrameIdx() < nFrames; now++ {
+			to1 = deliver(&r1, to1, now)
+			to2 = deliver(&r2, to2, now)
+			to2 = step(&r1, input1, to2, now)
+			to1 = step(&r2, input2, to1, now)
+			assert.Less(t, now, 10*nFrames)
+		}
+
+		assert.Equal(t, direct.GetChecksums(), wr1.GetChecksums())
+		assert.Equal(t, direct.GetChecksums(), wr2.GetChecksums())
+		assert.Equal(t, direct.GetWorld().Checksum(), r1.GetWorld().Checksum())
+		assert.Equal(t, direct.GetWorld().Checksum(), r2.GetWorld().Checksum())
+	}
+}
+
+// On a real network inputs come late or twice. An input for a frame whose
+// input is already known changes nothing, even if it says something else.
+func TestRollbackRunner_LateAndDuplicatedInputs(t *testing.T) {
+	const nFrames = 100
+	const maxFrames = 10
+	c := testWorldConfig()
+	var direct WorldRunner
+	direct.InitializeLockstep("", 42, c)
+	for i := 0; i < nFrames; i++ {
+		direct.Step(Input{Players: []PlayerInput{input1(i), input2(i)}})
+	}
+
+	var wr WorldRunner
+	wr.InitializeLockstep("", 42, c)
+	var r RollbackRunner
+	r.Initialize(&wr, 1, maxFrames)
+	wrong := PlayerInput{MoveUp: true, Shoot: true}
+	for i := 0; i < nFrames; i++ {
+		// Frames whose input comes before the frame is run, frames whose
+		// input comes after it is run but before it is final, and frames
+		// that are final before the input comes again.
+		if i%2 == 0 {
+			r.SetRemoteInput(i, input2(i))
+			r.SetRemoteInput(i, wrong)
+		}
+		r.Step(input1(i))
+		if i%2 == 1 {
+			r.SetRemoteInput(i, input2(i))
+			r.SetRemoteInput(i, wrong)
+		}
+		if i > 0 {
+			r.SetRemoteInput(i-1, wrong)
+		}
+	}
+	assert.Equal(t, direct.GetWorld().Checksum(), r.GetWorld().Checksum())
+}
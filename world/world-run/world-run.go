@@ -1,47 +1,341 @@
 package world_run
 
 import (
+	"bytes"
+	"errors"
 	. "playful-patterns.com/bakoko/ints"
 	. "playful-patterns.com/bakoko/world"
+	"time"
 )
 
+// When playing back a recording, the inputs of the players after the first
+// one can either be the recorded ones or they can be generated again by the
+// current AI.
+// Only the recorded inputs are guaranteed to reproduce the playthrough, if
+// the AI changed or if a player was a human, simulating gives a different
+// playthrough. Simulating is useful for seeing how a changed AI reacts to
+// an old playthrough.
+type Player2Source int
+
+const (
+	Player2Recorded Player2Source = iota
+	Player2Simulated
+)
+
+func DefaultPlayer2Source(r *Recording) Player2Source {
+	if r.HasPlayer2Inputs() {
+		return Player2Recorded
+	}
+	return Player2Simulated
+}
+
 type WorldRunner struct {
 	w             World
 	frameIdx      int
 	watcher       FolderWatcher
 	recordingFile string
-	currentInputs []PlayerInput
+	// Everything that happened since the runner was initialized. It is
+	// appended to recordingFile after every step, if there is a
+	// recordingFile.
+	recording Recording
+	recorder  RecordingWriter
+	// The recording being played back, if any. Whenever the world is
+	// reloaded during playback, the config is taken from this recording
+	// instead of from the disk.
+	playback *Recording
+	// The state of the AI from the saved state loaded since the last step.
+	loadedAIState []byte
+	// If set, the world is always loaded from this config instead of from
+	// the disk.
+	fixedConfig *WorldConfig
+}
+
+func (wr *WorldRunner) Initialize(recordingFile string, aiIdentity string,
+	folderWatchingEnabled bool) {
+	wr.initialize(recordingFile, aiIdentity, folderWatchingEnabled,
+		time.Now().UnixNano(), nil)
+}
+
+// InitializeLockstep is Initialize for a world that runs in lockstep with
+// the world of another player. Both worlds must start from the same seed
+// and load the same config every time, whatever the files on the disks of
+// the players say.
+func (wr *WorldRunner) InitializeLockstep(recordingFile string, seed int64,
+	c WorldConfig) {
+	wr.initialize(recordingFile, "lockstep", false, seed, &c)
 }
 
-func (wr *WorldRunner) Initialize(recordingFile string, folderWatchingEnabled bool) {
+func (wr *WorldRunner) initialize(recordingFile string, aiIdentity string,
+	folderWatchingEnabled bool, seed int64, fixedConfig *WorldConfig) {
 	wr.frameIdx = 0
+	wr.watcher = FolderWatcher{}
 	if folderWatchingEnabled {
 		wr.watcher.Folder = Home("world-data")
 	}
 	wr.recordingFile = recordingFile
-	LoadWorld(&wr.w)
+	wr.playback = nil
+	wr.fixedConfig = fixedConfig
+	wr.recording = Recording{}
+	wr.recording.Version = RecordingVersion
+	wr.recording.Seed = seed
+	wr.recording.AIIdentity = aiIdentity
+	wr.closeRecorder()
+	if wr.recordingFile != "" {
+		wr.recorder.Initialize(wr.recordingFile, wr.recording.Seed, aiIdentity)
+	}
+	RSeed(I64(wr.recording.Seed))
+	wr.loadedAIState = nil
+	wr.loadWorld(InitialConfigFrame)
 }
 
-func (wr *WorldRunner) Step(input Input) {
-	if wr.recordingFile != "" {
-		wr.currentInputs = append(wr.currentInputs, input.Player1Input)
-		SerializeInputs(wr.currentInputs, wr.recordingFile)
+// InitializePlayback resets the runner to the start of a recording. The
+// caller is responsible for feeding the recorded inputs to Step.
+func (wr *WorldRunner) InitializePlayback(playback *Recording) {
+	wr.frameIdx = 0
+	wr.watcher = FolderWatcher{}
+	wr.recordingFile = ""
+	wr.closeRecorder()
+	wr.playback = playback
+	wr.fixedConfig = nil
+	wr.recording = Recording{}
+	wr.recording.Version = RecordingVersion
+	wr.recording.Seed = playback.Seed
+	wr.recording.AIIdentity = playback.AIIdentity
+	RSeed(I64(playback.Seed))
+	wr.loadedAIState = nil
+	wr.loadWorld(InitialConfigFrame)
+	wr.loadPlaybackState()
+}
+
+// RunnerSnapshot is the state of a WorldRunner at the start of a frame.
+// Playback can continue from a snapshot instead of replaying all the frames
+// before it.
+type RunnerSnapshot struct {
+	FrameIdx int
+	World    []byte
+}
+
+func (wr *WorldRunner) TakeSnapshot() (s RunnerSnapshot) {
+	s.FrameIdx = wr.frameIdx
+	s.World = wr.w.Serialize()
+	return
+}
+
+// RestoreSnapshot continues the playback from a snapshot taken during the
+// playback of the same recording. Whatever the runner recorded after the
+// snapshot is discarded.
+func (wr *WorldRunner) RestoreSnapshot(s RunnerSnapshot) {
+	if wr.playback == nil {
+		Check(errors.New("snapshots can only be restored during playback"))
+	}
+
+	wr.w.Deserialize(bytes.NewBuffer(s.World))
+
+	wr.frameIdx = s.FrameIdx
+	if len(wr.recording.Inputs) > s.FrameIdx {
+		wr.recording.Inputs = wr.recording.Inputs[:s.FrameIdx]
+		wr.recording.Checksums = wr.recording.Checksums[:s.FrameIdx]
+	}
+
+	// If a state was loaded at this frame, the snapshot has the world after
+	// the load but the caller's AI may not have seen the state yet.
+	wr.loadedAIState = nil
+	wr.loadPlaybackState()
+}
+
+// SavedState is everything needed to continue a game from a certain point.
+// The runner knows nothing about the AI, so the state of the AI comes from
+// whoever drives the AI.
+type SavedState struct {
+	Version  int64
+	FrameIdx int64
+	World    []byte
+	AIState  []byte
+}
+
+// Saved states without a version are from before the worlds had any number
+// of players, and have worlds of two players, see World.DeserializeLegacy.
+// Version 1 has worlds with any number of players.
+const SavedStateVersion = 1
+
+// Old saved states start right away with the frame index, new ones start
+// with this.
+const savedStateMagic = "BKKSAV"
+
+func (s *SavedState) Serialize() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString(savedStateMagic)
+	Serialize(buf, s.Version)
+	Serialize(buf, s.FrameIdx)
+	SerializeSlice(buf, s.World)
+	SerializeSlice(buf, s.AIState)
+	return buf.Bytes()
+}
+
+// Deserialize reads a saved state of any version. The saved states without a
+// version get version 0.
+func (s *SavedState) Deserialize(buf *bytes.Buffer) {
+	s.Version = 0
+	if bytes.HasPrefix(buf.Bytes(), []byte(savedStateMagic)) {
+		buf.Next(len(savedStateMagic))
+		Deserialize(buf, &s.Version)
+	}
+	Deserialize(buf, &s.FrameIdx)
+	DeserializeSlice(buf, &s.World)
+	DeserializeSlice(buf, &s.AIState)
+}
+
+// SaveState writes the current state of the game to a file.
+func (wr *WorldRunner) SaveState(filename string, aiState []byte) {
+	s := SavedState{SavedStateVersion, int64(wr.frameIdx), wr.w.Serialize(),
+		aiState}
+	Zip(filename, s.Serialize())
+}
+
+// LoadState continues the game from a state written by SaveState.
+// The state is added to the recording, so that the recording can still be
+// played back. For the same reason, the frame index of the runner keeps
+// counting from where it was, as it is the position in the recording. The
+// frame index in the state only tells when the state was saved.
+// The caller must restore its AI from GetLoadedAIState.
+// States written before there were versions are loaded too.
+func (wr *WorldRunner) LoadState(filename string) {
+	if wr.playback != nil {
+		Check(errors.New("states can't be loaded during playback"))
+	}
+
+	var s SavedState
+	s.Deserialize(bytes.NewBuffer(Unzip(filename)))
+	wr.applyState(s, s.Version == 0)
+
+	// The recording gets the state in the current version, whatever the
+	// version of the file, so that playback doesn't have to guess it.
+	s.Version = SavedStateVersion
+	s.World = wr.w.Serialize()
+	r := RecordedState{int64(wr.frameIdx), s.Serialize()}
+	wr.recording.States = append(wr.recording.States, r)
+	if wr.recorder.IsOpen() {
+		wr.recorder.WriteState(r)
+	}
+}
+
+// GetLoadedAIState returns the state of the AI, if a saved state was loaded
+// since the last step. Whoever drives the AI must restore this state before
+// the AI reacts to the world again.
+func (wr *WorldRunner) GetLoadedAIState() []byte {
+	return wr.loadedAIState
+}
+
+func (wr *WorldRunner) applyState(s SavedState, legacyWorld bool) {
+	if legacyWorld {
+		wr.w.DeserializeLegacy(bytes.NewBuffer(s.World))
+	} else {
+		wr.w.Deserialize(bytes.NewBuffer(s.World))
+	}
+	wr.loadedAIState = s.AIState
+}
+
+// During playback, load the state that was loaded at the current frame
+// while recording, if there is one.
+func (wr *WorldRunner) loadPlaybackState() {
+	if wr.playback == nil {
+		return
+	}
+	if state, ok := wr.playback.GetState(int64(wr.frameIdx)); ok {
+		var s SavedState
+		s.Deserialize(bytes.NewBuffer(state))
+		// The states of recordings that are older than the saved state
+		// versions have no version either way, their worlds are legacy
+		// worlds if the recording says so.
+		wr.applyState(s, s.Version == 0 && wr.playback.HasLegacyWorlds())
+	}
+}
+
+func (wr *WorldRunner) loadWorld(frameIdx int64) {
+	if wr.playback != nil {
+		if c, ok := wr.playback.GetConfig(frameIdx); ok {
+			LoadWorldFromConfig(&wr.w, c)
+		} else {
+			// Old recordings don't contain their configs, so the best we can
+			// do is to use the config on disk.
+			LoadWorld(&wr.w)
+		}
+		return
 	}
 
-	//if input.Player1Input.Quit || input.Player2Input.Quit {
-	//	break
-	//}
+	var c RecordedConfig
+	c.FrameIdx = frameIdx
+	if wr.fixedConfig != nil {
+		c.Config = *wr.fixedConfig
+	} else {
+		c.Config = LoadWorldConfig()
+	}
+	LoadWorldFromConfig(&wr.w, c.Config)
+	wr.recording.Configs = append(wr.recording.Configs, c)
+	if wr.recorder.IsOpen() {
+		wr.recorder.WriteConfig(c)
+	}
+}
+
+// Close finishes the recording file, if there is one. If Close is never
+// called, the recording can still be read, but the last frames may be lost.
+func (wr *WorldRunner) Close() {
+	wr.closeRecorder()
+}
 
-	wr.w.JustReloaded = ZERO
-	if input.Player1Input.Reload || input.Player2Input.Reload || wr.watcher.FolderContentsChanged() {
-		LoadWorld(&wr.w)
+func (wr *WorldRunner) closeRecorder() {
+	if wr.recorder.IsOpen() {
+		wr.recorder.Close()
 	}
+}
+
+func (wr *WorldRunner) Step(input Input) {
+
+	// Whoever drives the AI had its chance to restore the AI state.
+	wr.loadedAIState = nil
 
-	if !input.Player1Input.Pause && !input.Player2Input.Pause {
-		wr.w.Step(&input, wr.frameIdx)
+	reload := input.Reload() || wr.watcher.FolderContentsChanged()
+	if wr.playback != nil {
+		// If the files on disk changed while recording, the world was
+		// reloaded without any input asking for it. The only trace of this
+		// is the config stored in the recording.
+		_, configChanged := wr.playback.GetConfig(int64(wr.frameIdx))
+		reload = reload || configChanged
+	}
+	checksum := stepFrame(&wr.w, &input, wr.frameIdx, reload, func() {
+		wr.loadWorld(int64(wr.frameIdx))
+	})
+	wr.recording.Inputs = append(wr.recording.Inputs, input)
+	wr.recording.Checksums = append(wr.recording.Checksums, checksum)
+	if wr.recorder.IsOpen() {
+		wr.recorder.WriteFrame(input, checksum)
 	}
 
 	wr.frameIdx++
+	wr.loadPlaybackState()
+}
+
+// stepFrame does to a world what a frame does to it. Both WorldRunner and
+// RollbackRunner run their frames with it, so that the world the
+// RollbackRunner runs ahead is the world the WorldRunner gets to.
+// If reload is set, load reloads the world before the frame. The checksum
+// of the world after the frame is returned.
+func stepFrame(w *World, input *Input, frameIdx int, reload bool,
+	load func()) uint64 {
+	w.JustReloaded = ZERO
+	// Nothing happened in this frame yet, and nothing will if it is paused.
+	w.Events = nil
+	if reload {
+		load()
+	}
+	if !input.Pause() {
+		w.Step(input, frameIdx)
+	}
+	return w.Checksum()
+}
+
+func (wr *WorldRunner) GetFrameIdx() int {
+	return wr.frameIdx
 }
 
 func (wr *WorldRunner) GetWorld() *World {
@@ -51,3 +345,8 @@ func (wr *WorldRunner) GetWorld() *World {
 func (wr *WorldRunner) GetDebugInfo() *DebugInfo {
 	return &wr.w.DebugInfo
 }
+
+// GetChecksums returns the checksum of the world after each step so far.
+func (wr *WorldRunner) GetChecksums() []uint64 {
+	return wr.recording.Checksums
+}
@@ -0,0 +1,73 @@
+package world_run
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	. "playful-patterns.com/bakoko/ints"
+	. "playful-patterns.com/bakoko/world"
+	"testing"
+)
+
+// A game continues from a saved state, also from a state saved before the
+// worlds had any number of players.
+func TestWorldRunner_SaveStateLoadState(t *testing.T) {
+	var wr WorldRunner
+	wr.InitializeLockstep("", 42, testWorldConfig())
+	for i := 0; i < 5; i++ {
+		wr.Step(Input{Players: []PlayerInput{{MoveRight: true}, {}}})
+	}
+	filename := filepath.Join(t.TempDir(), "saved-state.bks")
+	wr.SaveState(filename, []byte{1, 2, 3})
+	saved := wr.GetWorld().Serialize()
+
+	for i := 0; i < 5; i++ {
+		wr.Step(Input{Players: []PlayerInput{{MoveDown: true}, {}}})
+	}
+	wr.LoadState(filename)
+	assert.Equal(t, saved, wr.GetWorld().Serialize())
+	assert.Equal(t, []byte{1, 2, 3}, wr.GetLoadedAIState())
+
+	// The players of old states were always these, in this order.
+	type legacyPlayer struct {
+		Bounds            Circle
+		NBalls            Int
+		BallType          Int
+		Health            Int
+		Speed             Int
+		State             Int
+		StunnedImobilizes bool
+		StunnedTime       Int
+	}
+	w := wr.GetWorld().Clone()
+	w.Players[1].Health = I(2)
+	var legacy [2]legacyPlayer
+	for i, p := range w.Players {
+		legacy[i] = legacyPlayer{p.Bounds, p.NBalls, p.BallType, p.Health,
+			p.Speed, p.State, p.StunnedImobilizes, p.StunnedTime}
+	}
+	world := new(bytes.Buffer)
+	Serialize(world, legacy)
+	players := new(bytes.Buffer)
+	SerializeSlice(players, w.Players)
+	world.Write(w.Serialize()[players.Len():])
+
+	// Old states have no version, they start with the frame index.
+	state := new(bytes.Buffer)
+	Serialize(state, int64(3))
+	SerializeSlice(state, world.Bytes())
+	SerializeSlice(state, []byte{4})
+	Zip(filename, state.Bytes())
+
+	wr.LoadState(filename)
+	assert.Equal(t, I(2), wr.GetWorld().Players[1].Health)
+	assert.Equal(t, w.Serialize(), wr.GetWorld().Serialize())
+	assert.Equal(t, []byte{4}, wr.GetLoadedAIState())
+
+	// The recording has the state in the current version.
+	var s SavedState
+	s.Deserialize(bytes.NewBuffer(
+		wr.recording.States[len(wr.recording.States)-1].State))
+	assert.Equal(t, int64(SavedStateVersion), s.Version)
+	assert.Equal(t, int64(3), s.FrameIdx)
+}
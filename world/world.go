@@ -2,9 +2,10 @@ package world
 
 import (
 	"bytes"
-	"fmt"
+	"encoding/json"
 	"io"
 	. "playful-patterns.com/bakoko/ints"
+	"slices"
 )
 
 type Ball struct {
@@ -24,6 +25,9 @@ type Player struct {
 	State             Int
 	StunnedImobilizes bool
 	StunnedTime       Int
+	// Players of the same team don't hit each other and can collect each
+	// other's balls. A player without a team (0) plays on its own.
+	Team Int
 }
 
 var PlayerRegular = I(0)
@@ -49,10 +53,22 @@ func (m *Matrix) Serialize(w io.Writer) {
 }
 
 func (m *Matrix) Deserialize(buf *bytes.Buffer) {
-	Deserialize(buf, &m.nRows)
-	Deserialize(buf, &m.nCols)
-	m.cells = make([]Int, m.nRows.Times(m.nCols).ToInt64())
-	Deserialize(buf, m.cells)
+	r := Reader{Buf: buf}
+	m.Read(&r)
+	Check(r.Err)
+}
+
+func (m *Matrix) Read(r *Reader) {
+	r.Read(&m.nRows)
+	r.Read(&m.nCols)
+	nRows, nCols := m.nRows.ToInt64(), m.nCols.ToInt64()
+	// Check the factors first, so that their product can't overflow.
+	if !r.Fits(nRows, 8) || !r.Fits(nCols, 8) || !r.Fits(nRows*nCols, 8) {
+		*m = Matrix{}
+		return
+	}
+	m.cells = make([]Int, nRows*nCols)
+	r.Read(m.cells)
 }
 
 func (m *Matrix) Init(nRows, nCols Int) {
@@ -95,8 +111,7 @@ func (m *Matrix) IndexToPt(i Int) (p Pt) {
 }
 
 type World struct {
-	Player1      Player
-	Player2      Player
+	Players      []Player
 	Balls        []Ball
 	Over         Int
 	Obstacles    Matrix
@@ -106,6 +121,9 @@ type World struct {
 	BallDiameter Int
 	DebugInfo    DebugInfo
 	JustReloaded Int
+	// What happened during the last step. The events are not part of the
+	// state of the world, they are neither serialized nor checksummed.
+	Events []Event
 }
 
 type PlayerInput struct {
@@ -137,29 +155,105 @@ func DeserializeInputs(filename string) []PlayerInput {
 	return inputs
 }
 
+// Input is what the players did in a frame, in the same order as
+// World.Players. A player that has no input does nothing.
 type Input struct {
-	Player1Input PlayerInput
-	Player2Input PlayerInput
+	Players []PlayerInput
+}
+
+// Player returns the input of the player at index i of the world.
+func (in *Input) Player(i int) PlayerInput {
+	if i < len(in.Players) {
+		return in.Players[i]
+	}
+	return PlayerInput{}
+}
+
+// Reload tells if any player asked for the level to be reloaded.
+func (in *Input) Reload() bool {
+	for i := range in.Players {
+		if in.Players[i].Reload {
+			return true
+		}
+	}
+	return false
+}
+
+// Pause tells if any player paused the game.
+func (in *Input) Pause() bool {
+	for i := range in.Players {
+		if in.Players[i].Pause {
+			return true
+		}
+	}
+	return false
 }
 
+// Serialize writes every field of the world, so that the deserialized world
+// can be stepped exactly like the original.
 func (w *World) Serialize() []byte {
 	buf := new(bytes.Buffer)
-	Serialize(buf, w.Player1)
-	Serialize(buf, w.Player2)
+	SerializeSlice(buf, w.Players)
 	SerializeSlice(buf, w.Balls)
+	Serialize(buf, w.Over)
 	w.Obstacles.Serialize(buf)
 	Serialize(buf, w.ObstacleSize)
+	Serialize(buf, w.BallSpeed)
+	Serialize(buf, w.BallDec)
+	Serialize(buf, w.BallDiameter)
+	buf.Write(w.DebugInfo.Serialize())
 	Serialize(buf, w.JustReloaded)
 	return buf.Bytes()
 }
 
 func (w *World) Deserialize(buf *bytes.Buffer) {
-	Deserialize(buf, &w.Player1)
-	Deserialize(buf, &w.Player2)
-	DeserializeSlice(buf, &w.Balls)
-	w.Obstacles.Deserialize(buf)
-	Deserialize(buf, &w.ObstacleSize)
-	Deserialize(buf, &w.JustReloaded)
+	r := Reader{Buf: buf}
+	w.Read(&r)
+	Check(r.Err)
+}
+
+// Read is Deserialize for a world that comes from someone else and may be
+// wrong, see Reader.
+func (w *World) Read(r *Reader) {
+	ReadSlice(r, &w.Players)
+	w.readRest(r)
+}
+
+// DeserializeLegacy reads a world serialized before the worlds had any number
+// of players, when they had exactly two players and no teams. Old
+// recordings have states with such worlds in them.
+func (w *World) DeserializeLegacy(buf *bytes.Buffer) {
+	var players [2]legacyPlayer
+	r := Reader{Buf: buf}
+	r.Read(&players)
+	w.Players = []Player{players[0].toPlayer(), players[1].toPlayer()}
+	w.readRest(&r)
+	Check(r.Err)
+}
+
+func (w *World) readRest(r *Reader) {
+	ReadSlice(r, &w.Balls)
+	r.Read(&w.Over)
+	w.Obstacles.Read(r)
+	r.Read(&w.ObstacleSize)
+	r.Read(&w.BallSpeed)
+	r.Read(&w.BallDec)
+	r.Read(&w.BallDiameter)
+	w.DebugInfo.Read(r)
+	r.Read(&w.JustReloaded)
+	w.Events = nil
+}
+
+// Clone makes a deep copy of the world, which can be stepped without
+// changing the original. It is cheaper than serializing and deserializing.
+func (w *World) Clone() (c World) {
+	c = *w
+	c.Players = slices.Clone(w.Players)
+	c.Balls = slices.Clone(w.Balls)
+	c.Obstacles = w.Obstacles.Clone()
+	c.DebugInfo = w.DebugInfo.Clone()
+	c.Events = slices.Clone(w.Events)
+	return
 }
 
 func (w *World) ShootBall(player *Player, pt Pt) {
@@ -188,6 +282,7 @@ func (w *World) ShootBall(player *Player, pt Pt) {
 		Type:           player.BallType,
 	}
 	w.Balls = append(w.Balls, ball)
+	w.addEvent(EventBallShot, w.playerIdx(player), ball.Type, ball.Bounds.Center)
 	// Infinite balls, for debugging purposes.
 	player.NBalls.Dec()
 }
@@ -214,10 +309,22 @@ func ShootBallDebug(balls *[]Ball, orig, dest Pt, speed Int, ballDiameter Int) {
 // The logic of this function is that the circle travels for a length of
 // travelLen in total and has no concept of time. So you can say it treats
 // the movement as uniform, as if moving with the same speed the whole time.
-func (w *World) Travel(c Circle, travelVec Pt, travelLen Int) (newPos Pt, newTravelVec Pt, stop bool) {
+// The positions of the circle when it bounced off obstacles, if it did, are
+// returned in the order of the bounces.
+// The circle stops at the first of the targets that it touches along the
+// way, if it touches any. hitIdx is the index of that target, or -1. hitLen
+// is how much the circle travelled until it touched the target, which is
+// also when it touched it, since the movement is uniform: the hit happened
+// after hitLen / travelLen of the travel.
+// Checking the targets along the way instead of only at newPos is what keeps
+// a fast circle from going through a target without ever touching it.
+func (w *World) Travel(c Circle, travelVec Pt, travelLen Int,
+	targets []Circle) (newPos Pt, newTravelVec Pt, stop bool, bounces []Pt,
+	hitIdx int, hitLen Int) {
 	oldPos := c.Center
+	// How much we travelled before oldPos.
+	travelled := ZERO
 
-	bounces := 0
 	for {
 		// Given an original position and a travel vector, compute the new
 		// position.
@@ -228,14 +335,25 @@ func (w *World) Travel(c Circle, travelVec Pt, travelLen Int) (newPos Pt, newTra
 		// CircleSquareCollision doesn't return oldPos as a collision point.
 		intersects, circlePositionAtCollision, collisionNormal :=
 			CircleSquaresCollision(oldPos, newPos, c.Diameter, obstacles)
+
+		// Check if we touch a target before we get to newPos or to the
+		// obstacle, whichever comes first.
+		segmentEnd := newPos
+		if intersects {
+			segmentEnd = circlePositionAtCollision
+		}
+		idx, hitPos := CircleCirclesCollision(oldPos, segmentEnd, c.Diameter,
+			targets)
+		if idx >= 0 {
+			hitLen = travelled.Plus(oldPos.To(hitPos).Len())
+			return hitPos, travelVec, false, bounces, idx, hitLen
+		}
+
 		if !intersects {
 			// No collision, so we're fine, newPos is the final position.
-			if bounces > 0 {
-				fmt.Print(bounces, " ")
-			}
-			return newPos, travelVec, false
+			return newPos, travelVec, false, bounces, -1, ZERO
 		}
-		bounces++
+		bounces = append(bounces, circlePositionAtCollision)
 
 		// We collided. We were supposed to travel travelLen but we only
 		// travelled part of that then collided.
@@ -255,19 +373,45 @@ func (w *World) Travel(c Circle, travelVec Pt, travelLen Int) (newPos Pt, newTra
 
 		// Update the travel length.
 		travelLen.Subtract(travelledLen)
+		travelled.Add(travelledLen)
 		// Update the travel direction.
 		travelVec.Reflect(collisionNormal)
 	}
 }
 
-func (w *World) UpdateBallPositions(balls []Ball, dec Int) {
+// A ball that hit a player while it travelled.
+type ballHit struct {
+	ball   int
+	player int
+	// The hit happened after hitLen / travelLen of the travel of the ball.
+	hitLen    Int
+	travelLen Int
+}
+
+// UpdateBallPositions moves the balls and returns the players they hit on
+// the way, in the order of the balls.
+func (w *World) UpdateBallPositions(balls []Ball, dec Int) (hits []ballHit) {
 	// update the state of each ball (move it, make it collectible)
 	for idx := range balls {
 		ball := &balls[idx]
 		if ball.Speed.Gt(I(0)) {
 			// move the ball
+			// A ball that touches a player it hits stops there.
 			var stop bool
-			ball.Bounds.Center, ball.MoveDir, stop = w.Travel(ball.Bounds, ball.MoveDir, ball.Speed)
+			var bounces []Pt
+			var hitIdx int
+			var hitLen Int
+			targets, players := w.ballTargets(*ball)
+			travelLen := ball.Speed
+			ball.Bounds.Center, ball.MoveDir, stop, bounces, hitIdx, hitLen =
+				w.Travel(ball.Bounds, ball.MoveDir, travelLen, targets)
+			for _, pos := range bounces {
+				w.addEvent(EventBallBounced, -1, ball.Type, pos)
+			}
+			if hitIdx >= 0 {
+				hits = append(hits,
+					ballHit{idx, players[hitIdx], hitLen, travelLen})
+			}
 
 			if stop {
 				ball.Speed = I(0)
@@ -284,6 +428,53 @@ func (w *World) UpdateBallPositions(balls []Ball, dec Int) {
 			ball.CanBeCollected = true
 		}
 	}
+	return
+}
+
+// The players that a ball hits when it touches them, and their indexes in
+// w.Players.
+func (w *World) ballTargets(ball Ball) (targets []Circle, players []int) {
+	for i := range w.Players {
+		if !w.FriendlyBall(w.Players[i], ball) {
+			targets = append(targets, w.Players[i].Bounds)
+			players = append(players, i)
+		}
+	}
+	return
+}
+
+// The balls hit the players in the order in which the hits happened during
+// the frame, and are gone. A ball that travels faster gets further in the
+// same time, so the hits are compared by the part of the travel after which
+// they happened.
+func (w *World) handleBallHits(hits []ballHit) {
+	slices.SortStableFunc(hits, func(a, b ballHit) int {
+		// a.hitLen / a.travelLen compared to b.hitLen / b.travelLen.
+		x := a.hitLen.Times(b.travelLen)
+		y := b.hitLen.Times(a.travelLen)
+		if x.Lt(y) {
+			return -1
+		}
+		if y.Lt(x) {
+			return 1
+		}
+		return 0
+	})
+
+	toBeDeleted := make([]bool, len(w.Balls))
+	for _, hit := range hits {
+		w.hitPlayer(&w.Players[hit.player], int64(hit.player),
+			w.Balls[hit.ball])
+		toBeDeleted[hit.ball] = true
+	}
+
+	var newBalls []Ball
+	for idx, ball := range w.Balls {
+		if !toBeDeleted[idx] {
+			newBalls = append(newBalls, ball)
+		}
+	}
+	w.Balls = newBalls
 }
 
 func (w *World) MovePlayer(player *Player, newPos Pt) {
@@ -369,32 +560,84 @@ func PlayerAndBallAreTouching(player Player, ball Ball) bool {
 	return CirclesIntersect(player.Bounds, ball.Bounds)
 }
 
-func FriendlyBall(player Player, ball Ball) bool {
-	return player.BallType.Eq(ball.Type)
+// FriendlyBall tells if the ball belongs to the player or to one of its
+// teammates. Friendly balls can be collected, the others hit.
+func (w *World) FriendlyBall(player Player, ball Ball) bool {
+	if player.BallType.Eq(ball.Type) {
+		return true
+	}
+	if player.Team.Eq(ZERO) {
+		return false
+	}
+	for i := range w.Players {
+		if w.Players[i].Team.Eq(player.Team) &&
+			w.Players[i].BallType.Eq(ball.Type) {
+			return true
+		}
+	}
+	return false
+}
+
+// Teammates tells if the players at indexes i and j play on the same side.
+func (w *World) Teammates(i, j int) bool {
+	if i == j {
+		return true
+	}
+	team := w.Players[i].Team
+	return team.Neq(ZERO) && team.Eq(w.Players[j].Team)
+}
+
+func (p *Player) Defeated() bool {
+	return p.Health.Eq(ZERO)
+}
+
+// EnemiesDefeated tells if every player that is not on the side of the
+// player at index i is defeated.
+func (w *World) EnemiesDefeated(i int) bool {
+	for j := range w.Players {
+		if !w.Teammates(i, j) && !w.Players[j].Defeated() {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchOver tells if the players that are still standing are all on the
+// same side, or if nobody is standing anymore.
+func (w *World) MatchOver() bool {
+	standing := -1
+	for i := range w.Players {
+		if w.Players[i].Defeated() {
+			continue
+		}
+		if standing < 0 {
+			standing = i
+		} else if !w.Teammates(standing, i) {
+			return false
+		}
+	}
+	return true
 }
 
 func (w *World) HandlePlayerBallInteraction(player *Player, balls *[]Ball) {
+	playerIdx := w.playerIdx(player)
 	toBeDeleted := make([]bool, len(*balls))
 	for idx, ball := range *balls {
 		if !PlayerAndBallAreTouching(*player, ball) {
 			continue
 		}
 
-		if FriendlyBall(*player, ball) {
+		if w.FriendlyBall(*player, ball) {
 			if ball.CanBeCollected {
 				toBeDeleted[idx] = true
 				// Disable this for debugging purposes.
 				player.NBalls.Inc()
+				w.addEvent(EventBallCollected, playerIdx, ball.Type,
+					ball.Bounds.Center)
 			}
 		} else {
-			if player.Health.Gt(I(0)) {
-				player.Health.Dec()
-				player.StunnedTime = I(30)
-				player.State = PlayerStunned
-			}
+			w.hitPlayer(player, playerIdx, ball)
 			toBeDeleted[idx] = true
-			// Disable this for debugging purposes.
-			player.NBalls.Inc()
 		}
 	}
 
@@ -415,50 +658,101 @@ func (w *World) HandlePlayerBallInteraction(player *Player, balls *[]Ball) {
 	return
 }
 
+// A ball that isn't friendly hits the player.
+func (w *World) hitPlayer(player *Player, playerIdx int64, ball Ball) {
+	w.addEvent(EventPlayerHit, playerIdx, ball.Type, ball.Bounds.Center)
+	if player.Health.Gt(I(0)) {
+		player.Health.Dec()
+		player.StunnedTime = I(30)
+		player.State = PlayerStunned
+		w.addEvent(EventPlayerStunned, playerIdx, ZERO,
+			player.Bounds.Center)
+		if player.Defeated() {
+			w.addEvent(EventPlayerDefeated, playerIdx, ZERO,
+				player.Bounds.Center)
+		}
+	}
+	// Disable this for debugging purposes.
+	player.NBalls.Inc()
+}
+
 func (w *World) Step(input *Input, frameIdx int) {
 	w.DebugInfo = DebugInfo{} // reset
+	w.Events = nil
 
-	w.HandlePlayerInput(&w.Player1, input.Player1Input)
+	for i := range w.Players {
+		w.HandlePlayerInput(&w.Players[i], input.Player(i))
+	}
 	if frameIdx == 10 {
 		//ShootBallDebug(&w.Balls, UPt(200, 250), UPt(1000, 2000), MU(200000))
 	}
-	w.HandlePlayerInput(&w.Player2, input.Player2Input)
 
-	w.UpdateBallPositions(w.Balls, w.BallDec)
-	w.HandlePlayerBallInteraction(&w.Player1, &w.Balls)
-	w.HandlePlayerBallInteraction(&w.Player2, &w.Balls)
+	// The balls that hit players on the way are done. The others may still
+	// touch a player, like a ball that lies still and a player that walks
+	// into it.
+	w.handleBallHits(w.UpdateBallPositions(w.Balls, w.BallDec))
+	for i := range w.Players {
+		w.HandlePlayerBallInteraction(&w.Players[i], &w.Balls)
+	}
+	for i := range w.Events {
+		w.Events[i].FrameIdx = int64(frameIdx)
+	}
+}
+
+// WorldConfig holds everything that LoadWorld reads from disk: the contents
+// of world.json and the contents of the level file it points to.
+// Recordings keep a copy of it so that they can be replayed after the files
+// on disk have changed.
+type WorldConfig struct {
+	WorldJson string
+	Level     string
+}
+
+// LoadWorldConfig reads the current world configuration from disk.
+func LoadWorldConfig() (c WorldConfig) {
+	var data worldData
+	data, c.WorldJson = loadWorldData(Home("world-data"))
+	c.Level = ReadAllText(Home(data.Level))
+	return
 }
 
 func LoadWorld(w *World) {
+	LoadWorldFromConfig(w, LoadWorldConfig())
+}
+
+func LoadWorldFromConfig(w *World, c WorldConfig) {
 	*w = World{} // Reset everything.
 
-	data := loadWorldData(Home("world-data"))
+	var data worldData
+	err := json.Unmarshal([]byte(c.WorldJson), &data)
+	Check(err)
 
 	w.BallSpeed = I(data.BallSpeed)
 	w.BallDec = I(data.BallDec)
 	w.BallDiameter = I(data.BallDiameter)
-	w.Player1.Bounds.Center.X = I(data.Player1X)
-	w.Player1.Bounds.Center.Y = I(data.Player1Y)
-	w.Player1.Speed = I(data.Player1Speed)
-	w.Player1.Health = I(data.Player1Health)
-	w.Player1.NBalls = I(data.Player1NBalls)
-	w.Player1.BallType = I(data.Player1BallType)
-	w.Player1.Bounds.Diameter = I(data.Player1Diameter)
-	w.Player1.StunnedImobilizes = data.Player1StunnedImobilizes
-	w.Player2.Bounds.Center.X = I(data.Player2X)
-	w.Player2.Bounds.Center.Y = I(data.Player2Y)
-	w.Player2.Speed = I(data.Player2Speed)
-	w.Player2.Health = I(data.Player2Health)
-	w.Player2.NBalls = I(data.Player2NBalls)
-	w.Player2.BallType = I(data.Player2BallType)
-	w.Player2.Bounds.Diameter = I(data.Player2Diameter)
-	w.Player2.StunnedImobilizes = data.Player2StunnedImobilizes
+	for _, p := range data.players() {
+		var player Player
+		player.Bounds.Center.X = I(p.X)
+		player.Bounds.Center.Y = I(p.Y)
+		player.Speed = I(p.Speed)
+		player.Health = I(p.Health)
+		player.NBalls = I(p.NBalls)
+		player.BallType = I(p.BallType)
+		player.Bounds.Diameter = I(p.Diameter)
+		player.StunnedImobilizes = p.StunnedImobilizes
+		player.Team = I(p.Team)
+		w.Players = append(w.Players, player)
+	}
 	w.ObstacleSize = I(data.ObstacleSize)
-	levelString := ReadAllText(Home(data.Level))
 	var balls1 []Pt
 	//var balls2 []Pt
-	w.Obstacles, balls1, _ = LevelFromString(levelString)
+	w.Obstacles, balls1, _ = LevelFromString(c.Level)
 	w.Balls = []Ball{} // reset balls
+	// The balls of the level belong to the first player.
+	ballType := ZERO
+	if len(w.Players) > 0 {
+		ballType = w.Players[0].BallType
+	}
 	for i := range balls1 {
 		b := Ball{
 			//Pos:            Pt{player.Pos.X + (player.Diameter+30*Unit)/2 + 2*Unit, player.Pos.Y},
@@ -469,7 +763,7 @@ func LoadWorld(w *World) {
 			MoveDir:        IPt(0, 0),
 			Speed:          ZERO,
 			CanBeCollected: false,
-			Type:           w.Player1.BallType,
+			Type:           ballType,
 		}
 		w.Balls = append(w.Balls, b)
 	}
@@ -498,9 +792,70 @@ type worldData struct {
 	Player2StunnedImobilizes bool
 	ObstacleSize             int
 	Level                    string
+	// If there are Players, the Player1* and Player2* fields are ignored.
+	// They are there for the worlds made when there were always two
+	// players.
+	Players []playerData
+}
+
+type playerData struct {
+	X                 int
+	Y                 int
+	Speed             int
+	Health            int
+	NBalls            int
+	BallType          int
+	Diameter          int
+	StunnedImobilizes bool
+	Team              int
+}
+
+func (data *worldData) players() []playerData {
+	if len(data.Players) > 0 {
+		return data.Players
+	}
+	return []playerData{
+		{data.Player1X, data.Player1Y, data.Player1Speed, data.Player1Health,
+			data.Player1NBalls, data.Player1BallType, data.Player1Diameter,
+			data.Player1StunnedImobilizes, 0},
+		{data.Player2X, data.Player2Y, data.Player2Speed, data.Player2Health,
+			data.Player2NBalls, data.Player2BallType, data.Player2Diameter,
+			data.Player2StunnedImobilizes, 0},
+	}
+}
+
+// legacyPlayer is a Player from before teams, as old worlds and checksums
+// have it.
+type legacyPlayer struct {
+	Bounds            Circle
+	NBalls            Int
+	BallType          Int
+	Health            Int
+	Speed             Int
+	State             Int
+	StunnedImobilizes bool
+	StunnedTime       Int
+}
+
+func newLegacyPlayer(p Player) legacyPlayer {
+	return legacyPlayer{p.Bounds, p.NBalls, p.BallType, p.Health, p.Speed,
+		p.State, p.StunnedImobilizes, p.StunnedTime}
+}
+
+func (p *legacyPlayer) toPlayer() Player {
+	return Player{
+		Bounds:            p.Bounds,
+		NBalls:            p.NBalls,
+		BallType:          p.BallType,
+		Health:            p.Health,
+		Speed:             p.Speed,
+		State:             p.State,
+		StunnedImobilizes: p.StunnedImobilizes,
+		StunnedTime:       p.StunnedTime,
+	}
 }
 
-func loadWorldData(folder string) (data worldData) {
+func loadWorldData(folder string) (data worldData, worldJson string) {
 	// Read from the disk over and over until a full read is possible.
 	// This repetition is meant to avoid crashes due to reading files
 	// while they are still being written.
@@ -508,7 +863,9 @@ func loadWorldData(folder string) (data worldData) {
 	CheckCrashes = false
 	for {
 		CheckFailed = nil
-		LoadJSON(folder+"/world.json", &data)
+		worldJson = ReadAllText(folder + "/world.json")
+		err := json.Unmarshal([]byte(worldJson), &data)
+		Check(err)
 		if CheckFailed == nil {
 			break
 		}
@@ -0,0 +1,293 @@
+package world
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"image/color"
+	"playful-patterns.com/bakoko/internal/worldtest"
+	. "playful-patterns.com/bakoko/ints"
+	"testing"
+)
+
+func testWorldConfig() WorldConfig {
+	return WorldConfig{WorldJson: worldtest.WorldJson, Level: worldtest.Level}
+}
+
+func TestWorld_SerializeDeserialize(t *testing.T) {
+	var w World
+	LoadWorldFromConfig(&w, testWorldConfig())
+
+	// Get the world into a state where every field has something in it.
+	input := Input{Players: make([]PlayerInput, 2)}
+	input.Players[0].MoveDown = true
+	input.Players[0].Shoot = true
+	input.Players[0].ShootPt = w.Players[1].Bounds.Center
+	input.Players[1].Shoot = true
+	input.Players[1].ShootPt = w.Players[0].Bounds.Center
+	for i := 0; i < 5; i++ {
+		w.Step(&input, i)
+	}
+	w.Over = ONE
+	w.DebugInfo.Points = append(w.DebugInfo.Points,
+		DebugPoint{IPt(1, 2), I(3), color.RGBA{1, 2, 3, 4}})
+	w.DebugInfo.Lines = append(w.DebugInfo.Lines,
+		DebugLine{Line{IPt(1, 2), IPt(3, 4)}, color.RGBA{5, 6, 7, 8}})
+	// The events of the last step are not part of the state.
+	w.Events = nil
+
+	var w2 World
+	w2.Deserialize(bytes.NewBuffer(w.Serialize()))
+	assert.Equal(t, w, w2)
+
+	// The copy must evolve exactly like the original.
+	w.Step(&input, 5)
+	w2.Step(&input, 5)
+	assert.Equal(t, w, w2)
+	assert.Equal(t, w.Checksum(), w2.Checksum())
+}
+
+func TestWorld_Clone(t *testing.T) {
+	var w World
+	LoadWorldFromConfig(&w, testWorldConfig())
+	input := Input{Players: make([]PlayerInput, 2)}
+	input.Players[0].MoveDown = true
+	input.Players[0].Shoot = true
+	input.Players[0].ShootPt = w.Players[1].Bounds.Center
+	w.Step(&input, 0)
+	w.DebugInfo.Points = append(w.DebugInfo.Points,
+		DebugPoint{IPt(1, 2), I(3), color.RGBA{1, 2, 3, 4}})
+
+	c := w.Clone()
+	assert.Equal(t, w, c)
+
+	// Changing the clone doesn't change the original.
+	checksum := w.Checksum()
+	c.Balls[0].Bounds.Center.X = I(20000)
+	c.Obstacles.Set(ZERO, ZERO, I(5))
+	c.DebugInfo.Points[0].Size = I(4)
+	c.Players[1].Health = I(1)
+	input.Players[0].Shoot = false
+	c.Step(&input, 1)
+	assert.Equal(t, checksum, w.Checksum())
+	assert.Equal(t, I(3), w.DebugInfo.Points[0].Size)
+}
+
+// Two players without teams hash like they did when there were always two
+// players, so the checksums in old recordings still match.
+func TestWorld_ChecksumOfTwoPlayers(t *testing.T) {
+	var w World
+	LoadWorldFromConfig(&w, testWorldConfig())
+	input := Input{Players: make([]PlayerInput, 2)}
+	input.Players[0].MoveDown = true
+	input.Players[0].Shoot = true
+	input.Players[0].ShootPt = w.Players[1].Bounds.Center
+	input.Players[1].Shoot = true
+	input.Players[1].ShootPt = w.Players[0].Bounds.Center
+	for i := 0; i < 100; i++ {
+		w.Step(&input, i)
+	}
+	assert.Equal(t, uint64(0xbba926acb1a67a66), w.Checksum())
+
+	w.Players[1].Team = I(2)
+	assert.NotEqual(t, uint64(0xbba926acb1a67a66), w.Checksum())
+}
+
+func TestWorld_Teams(t *testing.T) {
+	c := testWorldConfig()
+	c.WorldJson = `{
+		"BallSpeed": 450, "BallDec": 3, "BallDiameter": 3700,
+		"ObstacleSize": 4000,
+		"Players": [
+			{"X": 10000, "Y": 10000, "Speed": 350, "Health": 3, "NBalls": 3,
+			 "BallType": 1, "Diameter": 5000, "Team": 1},
+			{"X": 30000, "Y": 10000, "Speed": 350, "Health": 3, "NBalls": 3,
+			 "BallType": 2, "Diameter": 5000, "Team": 1},
+			{"X": 30000, "Y": 18000, "Speed": 350, "Health": 3, "NBalls": 3,
+			 "BallType": 3, "Diameter": 5000}]}`
+	var w World
+	LoadWorldFromConfig(&w, c)
+	assert.Equal(t, 3, len(w.Players))
+	assert.True(t, w.Teammates(0, 1))
+	assert.False(t, w.Teammates(1, 2))
+	assert.False(t, w.MatchOver())
+
+	// A ball of a teammate is collected, a ball of an enemy hits.
+	ball := func(ballType int, pos Pt) Ball {
+		return Ball{Type: I(ballType), Bounds: Circle{pos, I(3700)}}
+	}
+	w.Balls = []Ball{
+		ball(2, w.Players[0].Bounds.Center),
+		ball(3, w.Players[1].Bounds.Center)}
+	w.Step(&Input{}, 0)
+	assert.Equal(t, I(4), w.Players[0].NBalls)
+	assert.Equal(t, I(3), w.Players[0].Health)
+	assert.Equal(t, I(2), w.Players[1].Health)
+	assert.Equal(t, PlayerStunned, w.Players[1].State)
+	assert.Equal(t, 0, len(w.Balls))
+
+	// The team wins once the player on its own is defeated, even if some of
+	// the team is defeated as well.
+	w.Players[1].Health = ZERO
+	assert.False(t, w.MatchOver())
+	w.Players[2].Health = ZERO
+	assert.True(t, w.MatchOver())
+	assert.True(t, w.EnemiesDefeated(0))
+	assert.False(t, w.EnemiesDefeated(2))
+}
+
+// States in old recordings have worlds with exactly two players.
+func TestWorld_DeserializeLegacy(t *testing.T) {
+	var w World
+	LoadWorldFromConfig(&w, testWorldConfig())
+	w.Players[1].Health = I(2)
+
+	buf := new(bytes.Buffer)
+	Serialize(buf, [2]legacyPlayer{newLegacyPlayer(w.Players[0]),
+		newLegacyPlayer(w.Players[1])})
+	players := new(bytes.Buffer)
+	SerializeSlice(players, w.Players)
+	buf.Write(w.Serialize()[players.Len():])
+
+	var w2 World
+	w2.DeserializeLegacy(buf)
+	assert.Equal(t, w, w2)
+}
+
+func TestWorld_Events(t *testing.T) {
+	var w World
+	LoadWorldFromConfig(&w, testWorldConfig())
+	w.Balls = nil
+
+	// The first player shoots at the second one.
+	input := Input{Players: []PlayerInput{
+		{Shoot: true, ShootPt: w.Players[1].Bounds.Center}}}
+	w.Step(&input, 7)
+	assert.Equal(t, []Event{{EventBallShot, 7, 0, I(1), Pt{I(10000), I(10000)}}},
+		w.Events)
+
+	// A ball bounces off the wall on the left, the first player collects a
+	// ball and the second player is hit for its last health point.
+	w.Players[1].Health = ONE
+	w.Balls = []Ball{
+		{Type: I(2), Bounds: Circle{Pt{I(6000), I(18000)}, I(3700)},
+			MoveDir: Pt{I(-1), I(0)}, Speed: I(450)},
+		{Type: I(1), Bounds: Circle{w.Players[1].Bounds.Center, I(3700)}},
+		{Type: I(1), Bounds: Circle{w.Players[0].Bounds.Center, I(3700)},
+			CanBeCollected: true}}
+	c := w.Clone()
+	w.Step(&Input{}, 8)
+	var types []EventType
+	for _, e := range w.Events {
+		types = append(types, e.Type)
+		assert.Equal(t, int64(8), e.FrameIdx)
+	}
+	assert.Equal(t, []EventType{EventBallBounced, EventBallCollected,
+		EventPlayerHit, EventPlayerStunned, EventPlayerDefeated}, types)
+	assert.Equal(t, int64(-1), w.Events[0].Player)
+	assert.Equal(t, I(2), w.Events[0].BallType)
+	assert.Equal(t, int64(0), w.Events[1].Player)
+	assert.Equal(t, int64(1), w.Events[2].Player)
+	assert.Equal(t, I(1), w.Events[2].BallType)
+	assert.Equal(t, w.Players[1].Bounds.Center, w.Events[4].Pos)
+
+	// The same step makes the same events.
+	c.Step(&Input{}, 8)
+	assert.Equal(t, w.Events, c.Events)
+
+	// The events are not part of the state of the world.
+	checksum := w.Checksum()
+	var w2 World
+	w2.Events = w.Events
+	w2.Deserialize(bytes.NewBuffer(w.Serialize()))
+	assert.Nil(t, w2.Events)
+	assert.Equal(t, checksum, w2.Checksum())
+
+	// Nothing happens in a step where nothing happens.
+	w.Balls = nil
+	w.Step(&Input{}, 9)
+	assert.Nil(t, w.Events)
+}
+
+func TestWorld_FastBallHitsPlayer(t *testing.T) {
+	var w World
+	LoadWorldFromConfig(&w, testWorldConfig())
+
+	// The ball is so fast that it would be past the second player at the end
+	// of the frame.
+	ball := Ball{Type: I(1), Bounds: Circle{IPt(22000, 10000), I(3700)},
+		MoveDir: IPt(1, 0), Speed: I(15000)}
+	targets, players := w.ballTargets(ball)
+	assert.Equal(t, []Circle{w.Players[1].Bounds}, targets)
+	assert.Equal(t, []int{1}, players)
+	newPos, _, stop, bounces, hitIdx, hitLen := w.Travel(ball.Bounds,
+		ball.MoveDir, ball.Speed, targets)
+	assert.False(t, stop)
+	assert.Empty(t, bounces)
+	assert.Equal(t, 0, hitIdx)
+	assert.InDelta(t, 30000-4350-22000, hitLen.ToInt64(), 50)
+	assert.True(t, CirclesIntersect(Circle{newPos, I(3700)},
+		w.Players[1].Bounds))
+
+	// Without the player, the ball goes all the way.
+	newPos, _, _, _, hitIdx, hitLen = w.Travel(ball.Bounds, ball.MoveDir,
+		ball.Speed, nil)
+	assert.Equal(t, -1, hitIdx)
+	assert.Equal(t, ZERO, hitLen)
+	assert.Equal(t, IPt(37000, 10000), newPos)
+
+	w.Balls = []Ball{ball}
+	w.Step(&Input{}, 0)
+	assert.Equal(t, I(5), w.Players[1].Health)
+	assert.Equal(t, 0, len(w.Balls))
+	assert.Equal(t, 1, len(EventsOf(w.Events, EventPlayerHit)))
+}
+
+// When balls hit players in the same frame, they hit them in the order of
+// when they got to them, not in the order of the balls.
+func TestWorld_BallHitsInOrder(t *testing.T) {
+	var w World
+	LoadWorldFromConfig(&w, testWorldConfig())
+	w.Players[1].Health = I(1)
+
+	// The first ball is slow and far, the second one is fast and close.
+	// The second one gets to the player first and defeats it.
+	slow := Ball{Type: I(1), Bounds: Circle{IPt(20000, 10000), I(3700)},
+		MoveDir: IPt(1, 0), Speed: I(8000)}
+	fast := Ball{Type: I(3), Bounds: Circle{IPt(24000, 10000), I(3700)},
+		MoveDir: IPt(1, 0), Speed: I(15000)}
+	w.Balls = []Ball{slow, fast}
+	w.Step(&Input{}, 0)
+	assert.Equal(t, 0, len(w.Balls))
+	hits := EventsOf(w.Events, EventPlayerHit)
+	assert.Equal(t, 2, len(hits))
+	assert.Equal(t, I(3), hits[0].BallType)
+	assert.Equal(t, I(1), hits[1].BallType)
+	assert.Equal(t, 1, len(EventsOf(w.Events, EventPlayerDefeated)))
+}
+
+// Data from the network may be anything, reading it fails instead of
+// panicking or allocating what it says.
+func TestReader(t *testing.T) {
+	buf := new(bytes.Buffer)
+	Serialize(buf, int64(1<<40))
+	r := Reader{Buf: buf}
+	var balls []Ball
+	ReadSlice(&r, &balls)
+	assert.ErrorIs(t, r.Err, ErrMalformedMessage)
+	assert.Nil(t, balls)
+
+	var w World
+	LoadWorldFromConfig(&w, testWorldConfig())
+	data := w.Serialize()
+	var w2 World
+	r = Reader{Buf: bytes.NewBuffer(data[:len(data)-3])}
+	w2.Read(&r)
+	assert.ErrorIs(t, r.Err, ErrMalformedMessage)
+	r = Reader{Buf: bytes.NewBuffer(data)}
+	w2.Read(&r)
+	assert.Nil(t, r.Err)
+	assert.Equal(t, w.Checksum(), w2.Checksum())
+
+	// Our own files are trusted, if they are wrong something is very off.
+	assert.Panics(t, func() { w2.Deserialize(bytes.NewBuffer(data[:10])) })
+}